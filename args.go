@@ -0,0 +1,170 @@
+// Package main provides secret references in command line arguments.
+//
+// This file contains the functions that resolve references in the child's
+// arguments, for programs that only take credentials as flags:
+//
+//	aws-init -resolve-args redis-server --requirepass aws-secret:myapp/redis#password
+//	aws-init -resolve-args app --dsn 'postgres://app:${aws-secret:myapp/db#password}@db/app'
+//
+// Arguments use the same reference formats as environment variables, and
+// ${VAR} in references expands from the environment (see vars.go). The
+// command itself is never resolved. An optional reference that is not
+// resolved becomes an empty argument.
+//
+// # Visibility
+//
+// Arguments are far more exposed than the environment: any process on the
+// host that can read /proc/<pid>/cmdline, or run ps, sees them. Resolution
+// is therefore opt-in with -resolve-args or AWS_INIT_RESOLVE_ARGS, and
+// aws-init logs a warning whenever it places a secret in an argument.
+// Prefer aws-secret-file: and aws-ssm-file: references, which put only the
+// path of the secret file in the argument:
+//
+//	aws-init -resolve-args nginx -c aws-secret-file:myapp/nginx#config
+//
+// # Logging
+//
+// With -resolve-args the "started" log line shows the arguments as written,
+// so references appear by name and never by value. -redact-args or
+// AWS_INIT_REDACT_ARGS replaces every argument holding a reference with
+// [redacted], for secret names that are themselves sensitive.
+//
+// # Watch Mode
+//
+// Arguments are resolved once at startup. Changes to secrets used only in
+// arguments are not watched, and a restarted child keeps its arguments.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// redactedArg replaces an argument holding a reference in log output.
+const redactedArg = "[redacted]"
+
+// resolveArgs resolves the references in args, the child's arguments after
+// the command, with the resolver of shared if resolution is enabled.
+// ${VAR} expands from environ.
+//
+// Returns args unchanged if resolution is off or nothing is referenced;
+// otherwise returns a report of every failed reference, as resolveSecrets
+// does.
+func resolveArgs(ctx context.Context, args, environ []string, shared *sharedResolver) ([]string, error) {
+	if !shared.opts.resolveArgs || !hasArgRefs(args) {
+		return args, nil
+	}
+
+	r, err := shared.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.resolveArgs(ctx, args, environ)
+}
+
+// resolveArgs resolves the references in args, naming them arg1, arg2 and
+// so on in errors, logs and default file names.
+func (r *resolver) resolveArgs(ctx context.Context, args, environ []string) ([]string, error) {
+	names := make([]string, len(args))
+	for i := range args {
+		names[i] = argName(i)
+	}
+
+	report := newErrorReport(names)
+	vars := newPlainVars(environ)
+	values := make(map[int][]valuePart)
+	var targets []fetchTarget
+	seen := make(map[fetchTarget]bool)
+
+	for i, arg := range args {
+		parts, ok := parseValue(names[i], arg, vars, report)
+		if !ok {
+			continue
+		}
+		for _, part := range parts {
+			if part.isRef && !seen[part.ref.target()] {
+				seen[part.ref.target()] = true
+				targets = append(targets, part.ref.target())
+			}
+		}
+		values[i] = parts
+	}
+
+	fetched := r.fetchBounded(ctx, targets)
+
+	resolved := make([]string, len(args))
+	var secrets []string
+	for i, arg := range args {
+		parts, ok := values[i]
+		if !ok {
+			resolved[i] = arg
+			continue
+		}
+
+		// An unresolved optional reference leaves the argument empty
+		resolved[i], _ = r.render(names[i], parts, fetched, report)
+		if !filesOnly(parts) {
+			secrets = append(secrets, names[i])
+		}
+	}
+
+	if err := report.err(); err != nil {
+		return nil, err
+	}
+
+	if len(secrets) > 0 {
+		log.Printf("aws-init: warning: secrets in %s are visible to other processes in /proc/<pid>/cmdline; prefer file references", strings.Join(secrets, ", "))
+	}
+
+	return resolved, nil
+}
+
+// argName returns the name of the argument at index i of the arguments
+// after the command, counting from 1 as argv does.
+func argName(i int) string {
+	return fmt.Sprintf("arg%d", i+1)
+}
+
+// hasArgRefs reports whether any argument may hold a reference.
+func hasArgRefs(args []string) bool {
+	for _, arg := range args {
+		if isArgRef(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// isArgRef reports whether arg holds a whole or interpolated reference.
+func isArgRef(arg string) bool {
+	return isReference(arg) || isInterpolated(arg)
+}
+
+// filesOnly reports whether every reference in parts is a file reference,
+// so that the value holds paths rather than secrets.
+func filesOnly(parts []valuePart) bool {
+	for _, part := range parts {
+		if part.isRef && !part.ref.file.enabled {
+			return false
+		}
+	}
+	return true
+}
+
+// describeCommand returns command and args as written for the "started" log
+// line, with arguments holding references replaced by [redacted] if redact
+// is set.
+func describeCommand(command string, args []string, redact bool) string {
+	words := append([]string{command}, args...)
+	if redact {
+		for i, arg := range args {
+			if isArgRef(arg) {
+				words[i+1] = redactedArg
+			}
+		}
+	}
+	return strings.Join(words, " ")
+}
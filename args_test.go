@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolverResolveArgs(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/redis": `{"password":"hunter2"}`,
+		"myapp/prod":  `{"user":"app","password":"s3cret"}`,
+	})
+	ps := newFakeSSM(map[string]string{"/myapp/prod/port": "6380"})
+	r := &resolver{secrets: sm, ssm: ps, parallel: 2}
+	environ := []string{"STAGE=prod"}
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			name: "plain arguments",
+			args: []string{"--port", "6379"},
+			want: []string{"--port", "6379"},
+		},
+		{
+			name: "whole reference",
+			args: []string{"--requirepass", "aws-secret:myapp/redis#password"},
+			want: []string{"--requirepass", "hunter2"},
+		},
+		{
+			name: "interpolated references",
+			args: []string{"--dsn=postgres://${aws-secret:myapp/prod#user}:${aws-secret:myapp/prod#password}@db/app"},
+			want: []string{"--dsn=postgres://app:s3cret@db/app"},
+		},
+		{
+			name: "parameter with variable",
+			args: []string{"--port", "aws-ssm:/myapp/${STAGE}/port"},
+			want: []string{"--port", "6380"},
+		},
+		{
+			name: "optional reference left empty",
+			args: []string{"--token", "aws-secret:myapp/missing|optional", "--verbose"},
+			want: []string{"--token", "", "--verbose"},
+		},
+		{
+			name: "default value",
+			args: []string{"aws-ssm:/myapp/prod/log_level|default=info"},
+			want: []string{"info"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.resolveArgs(context.Background(), tt.args, environ)
+			if err != nil {
+				t.Fatalf("resolveArgs() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverResolveArgsFile(t *testing.T) {
+	t.Cleanup(removeSecretFiles)
+
+	sm := newFakeSecretsManager(map[string]string{"myapp/tls": `{"key":"PRIVATE KEY"}`})
+	r := &resolver{secrets: sm, parallel: 2, secretsDir: t.TempDir()}
+
+	got, err := r.resolveArgs(context.Background(), []string{"--key", "aws-secret-file:myapp/tls#key"}, nil)
+	if err != nil {
+		t.Fatalf("resolveArgs() error = %v", err)
+	}
+	if filepath.Base(got[1]) != "arg2" {
+		t.Errorf("file path = %q, want default name arg2", got[1])
+	}
+	data, err := os.ReadFile(got[1])
+	if err != nil {
+		t.Fatalf("reading secret file: %v", err)
+	}
+	if string(data) != "PRIVATE KEY" {
+		t.Errorf("file content = %q, want %q", data, "PRIVATE KEY")
+	}
+}
+
+func TestResolverResolveArgsReportsFailures(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"myapp/redis": `{"password":"hunter2"}`})
+	r := &resolver{secrets: sm, parallel: 2}
+
+	args := []string{"aws-secret:myapp/missing", "--user", "aws-secret:myapp/redis#user", "aws-secret:myapp/${UNSET}"}
+	_, err := r.resolveArgs(context.Background(), args, nil)
+	if err == nil {
+		t.Fatal("resolveArgs() error = nil, want report")
+	}
+
+	msg := err.Error()
+	for _, want := range []string{
+		"failed to resolve 3 references",
+		"arg1: aws-secret:myapp/missing: not found",
+		"arg3: aws-secret:myapp/redis#user: key missing",
+		"arg4: invalid reference: column 18: variable UNSET is not set",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("error %q does not contain %q", msg, want)
+		}
+	}
+	if strings.Contains(msg, "hunter2") {
+		t.Errorf("error %q contains a secret value", msg)
+	}
+}
+
+func TestResolveArgsDisabled(t *testing.T) {
+	args := []string{"--requirepass", "aws-secret:myapp/redis#password"}
+
+	got, err := resolveArgs(context.Background(), args, nil, newSharedResolver(defaultOptions()))
+	if err != nil {
+		t.Fatalf("resolveArgs() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, args) {
+		t.Errorf("resolveArgs() = %q, want arguments unchanged", got)
+	}
+}
+
+func TestDescribeCommand(t *testing.T) {
+	args := []string{"--requirepass", "aws-secret:myapp/redis#password", "--dsn=${aws-ssm:/myapp/dsn}", "--port", "6379"}
+
+	tests := []struct {
+		redact bool
+		want   string
+	}{
+		{redact: false, want: "redis-server --requirepass aws-secret:myapp/redis#password --dsn=${aws-ssm:/myapp/dsn} --port 6379"},
+		{redact: true, want: "redis-server --requirepass [redacted] [redacted] --port 6379"},
+	}
+
+	for _, tt := range tests {
+		if got := describeCommand("redis-server", args, tt.redact); got != tt.want {
+			t.Errorf("describeCommand(redact=%v) = %q, want %q", tt.redact, got, tt.want)
+		}
+	}
+}
+
+func TestResolveArgsSharesResolver(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"myapp/redis": `{"password":"hunter2"}`})
+	opts := defaultOptions()
+	opts.resolveArgs = true
+	shared := &sharedResolver{opts: opts, r: &resolver{secrets: sm, parallel: 1, pass: make(map[fetchTarget]fetchResult)}}
+
+	args, err := resolveArgs(context.Background(), []string{"--requirepass", "aws-secret:myapp/redis#password"}, nil, shared)
+	if err != nil {
+		t.Fatalf("resolveArgs() error = %v", err)
+	}
+	env, err := resolveSecrets(context.Background(), []string{"REDIS_PASSWORD=aws-secret:myapp/redis#password"}, shared)
+	if err != nil {
+		t.Fatalf("resolveSecrets() error = %v", err)
+	}
+
+	if args[1] != "hunter2" || env[0] != "REDIS_PASSWORD=hunter2" {
+		t.Errorf("resolved args %q, env %q", args, env)
+	}
+	if sm.calls["myapp/redis"] != 1 {
+		t.Errorf("myapp/redis fetched %d times, want 1", sm.calls["myapp/redis"])
+	}
+}
@@ -0,0 +1,80 @@
+// Package main provides ECS valueFrom compatibility for ARN references.
+//
+// This file contains functions that parse Secrets Manager and Parameter
+// Store ARNs in the format ECS task definitions use for valueFrom, so that
+// the same reference strings work on ECS and, prefixed with aws-secret:,
+// anywhere aws-init runs.
+//
+// # Secrets Manager
+//
+// A secret ARN may be followed by the json-key, version-stage and
+// version-id fields of an ECS valueFrom, each of which may be empty:
+//
+//	aws-secret:arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db-AbCdEf
+//	aws-secret:arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db-AbCdEf:password::
+//	aws-secret:arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db-AbCdEf:password:AWSPREVIOUS:
+//	aws-secret:arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db-AbCdEf::AWSCURRENT:01234567-89ab-cdef-0123-456789abcdef
+//
+// As on ECS, json-key names a top-level key. The aws-init "#key" syntax
+// still works after an ARN without fields, but not together with json-key.
+//
+// # Parameter Store
+//
+// A parameter ARN is read from Parameter Store whether it follows aws-ssm:
+// or aws-secret:, as ECS does for valueFrom:
+//
+//	aws-secret:arn:aws:ssm:us-east-1:123456789012:parameter/myapp/prod/db_password
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// arnFields is the number of colon-separated fields in a secret ARN up to
+// and including the secret name.
+const arnFields = 7
+
+// isParameterARN reports whether name is a Parameter Store parameter ARN.
+func isParameterARN(name string) bool {
+	fields := strings.SplitN(name, ":", 6)
+	return len(fields) == 6 && fields[0] == "arn" && fields[2] == "ssm" && strings.HasPrefix(fields[5], "parameter/")
+}
+
+// parseSecretARN parses a Secrets Manager ARN with optional ECS valueFrom
+// fields: arn:partition:secretsmanager:region:account:secret:name, then
+// :json-key:version-stage:version-id.
+//
+// Returns an error if ref is not a Secrets Manager secret ARN or has more
+// fields than ECS defines.
+func parseSecretARN(ref string) (secretRef, error) {
+	fields := strings.Split(ref, ":")
+	if len(fields) < arnFields || fields[2] != "secretsmanager" || fields[5] != "secret" || fields[6] == "" {
+		return secretRef{}, fmt.Errorf("invalid secret ARN %s", ref)
+	}
+	if len(fields) > arnFields+3 {
+		return secretRef{}, fmt.Errorf("secret ARN %s has too many fields, want json-key:version-stage:version-id", ref)
+	}
+
+	parsed := secretRef{name: strings.Join(fields[:arnFields], ":")}
+
+	extra := append(fields[arnFields:], "", "", "")
+	if key := extra[0]; key != "" {
+		parsed.key = key
+		parsed.hasKey = true
+	}
+	parsed.versionStage = extra[1]
+	parsed.versionID = extra[2]
+
+	return parsed, nil
+}
+
+// describeSecretARN returns a secret ARN reference in ECS valueFrom form,
+// with only as many fields as it needs.
+func (ref secretRef) describeSecretARN() string {
+	fields := []string{ref.name, ref.key, ref.versionStage, ref.versionID}
+	for len(fields) > 1 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return secretPrefix + strings.Join(fields, ":")
+}
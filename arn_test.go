@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseSecretRefECS(t *testing.T) {
+	const arn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db-AbCdEf"
+	const id = "01234567-89ab-cdef-0123-456789abcdef"
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    secretRef
+		wantErr bool
+	}{
+		{
+			name: "bare arn",
+			ref:  "aws-secret:" + arn,
+			want: secretRef{name: arn, region: "us-east-1"},
+		},
+		{
+			name: "json key",
+			ref:  "aws-secret:" + arn + ":password::",
+			want: secretRef{name: arn, key: "password", hasKey: true, region: "us-east-1"},
+		},
+		{
+			name: "json key without trailing fields",
+			ref:  "aws-secret:" + arn + ":password",
+			want: secretRef{name: arn, key: "password", hasKey: true, region: "us-east-1"},
+		},
+		{
+			name: "version stage",
+			ref:  "aws-secret:" + arn + ":password:AWSPREVIOUS:",
+			want: secretRef{name: arn, key: "password", hasKey: true, versionStage: "AWSPREVIOUS", region: "us-east-1"},
+		},
+		{
+			name: "version id without key",
+			ref:  "aws-secret:" + arn + "::AWSCURRENT:" + id,
+			want: secretRef{name: arn, versionStage: "AWSCURRENT", versionID: id, region: "us-east-1"},
+		},
+		{
+			name: "hash key after bare arn",
+			ref:  "aws-secret:" + arn + "#db.host",
+			want: secretRef{name: arn, key: "db.host", hasKey: true, region: "us-east-1"},
+		},
+		{
+			name: "parameter arn after aws-secret",
+			ref:  "aws-secret:arn:aws:ssm:eu-west-1:123456789012:parameter/myapp/db_password",
+			want: secretRef{name: "arn:aws:ssm:eu-west-1:123456789012:parameter/myapp/db_password", parameter: true, region: "eu-west-1"},
+		},
+		{name: "json key and hash key", ref: "aws-secret:" + arn + ":password::#user", wantErr: true},
+		{name: "too many fields", ref: "aws-secret:" + arn + ":a:b:c:d", wantErr: true},
+		{name: "other service", ref: "aws-secret:arn:aws:s3:::bucket/key", wantErr: true},
+		{name: "missing name", ref: "aws-secret:arn:aws:secretsmanager:us-east-1:123456789012:secret:", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSecretRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSecretRef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSecretRef() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescribeSecretARN(t *testing.T) {
+	const arn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db-AbCdEf"
+
+	tests := []string{
+		"aws-secret:" + arn,
+		"aws-secret:" + arn + ":password",
+		"aws-secret:" + arn + ":password:AWSPREVIOUS",
+		"aws-secret:" + arn + "::AWSCURRENT:01234567-89ab-cdef-0123-456789abcdef",
+	}
+
+	for _, ref := range tests {
+		t.Run(ref, func(t *testing.T) {
+			parsed, err := parseSecretRef(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parsed.describe(); got != ref {
+				t.Errorf("describe() = %q, want %q", got, ref)
+			}
+		})
+	}
+}
+
+func TestResolverECSReferences(t *testing.T) {
+	const arn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db-AbCdEf"
+
+	sm := newFakeSecretsManager(map[string]string{
+		arn:                  `{"password":"hunter2"}`,
+		arn + ":AWSPREVIOUS": `{"password":"old"}`,
+	})
+	params := newFakeSSM(map[string]string{
+		"arn:aws:ssm:us-east-1:123456789012:parameter/myapp/flag": "on",
+	})
+	r := &resolver{secrets: sm, ssm: params, parallel: 2}
+
+	result, err := r.resolve(context.Background(), []string{
+		"PASSWORD=aws-secret:" + arn + ":password::",
+		"OLD_PASSWORD=aws-secret:" + arn + ":password:AWSPREVIOUS:",
+		"FLAG=aws-secret:arn:aws:ssm:us-east-1:123456789012:parameter/myapp/flag",
+	})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	got := envSliceToMap(result)
+	want := map[string]string{"PASSWORD": "hunter2", "OLD_PASSWORD": "old", "FLAG": "on"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
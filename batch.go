@@ -0,0 +1,193 @@
+// Package main provides batched AWS secret retrieval.
+//
+// This file contains functions that fetch many Secrets Manager secrets or
+// Parameter Store parameters in a single API call, and map per-item results
+// and errors back to the names that were requested.
+//
+// # Fallback
+//
+// A name that the batch response does not account for, or a batch call that
+// fails outright, is retried through the single-value APIs. This keeps
+// aws-init working with IAM policies that do not grant
+// secretsmanager:BatchGetSecretValue.
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	secretsBatchSize    = 20 // BatchGetSecretValue SecretIdList limit
+	parametersBatchSize = 10 // GetParameters Names limit
+)
+
+// recordFunc stores the outcome of fetching one target.
+type recordFunc func(t fetchTarget, res fetchResult)
+
+// fetchSecretBatch fetches up to secretsBatchSize secrets with the clients
+// selected by key and records a result for every name.
+func (r *resolver) fetchSecretBatch(ctx context.Context, key clientKey, names []string, record recordFunc) {
+	client := r.clients(key).secrets
+	fetchOne := func(name string) {
+		value, binary, err := getSecret(ctx, client, r.retry, name, "", "")
+		record(fetchTarget{name: name, region: key.region, role: key.role}, fetchResult{value: value, binary: binary, err: err})
+	}
+
+	if len(names) == 1 {
+		fetchOne(names[0])
+		return
+	}
+
+	results, err := getSecretBatch(ctx, client, r.retry, names)
+	if err != nil {
+		for _, name := range names {
+			fetchOne(name)
+		}
+		return
+	}
+
+	for _, name := range names {
+		if res, ok := results[name]; ok {
+			record(fetchTarget{name: name, region: key.region, role: key.role}, res)
+		} else {
+			fetchOne(name)
+		}
+	}
+}
+
+// fetchParameterBatch fetches up to parametersBatchSize parameters with the
+// clients selected by key and records a result for every name.
+func (r *resolver) fetchParameterBatch(ctx context.Context, key clientKey, names []string, record recordFunc) {
+	client := r.clients(key).ssm
+	fetchOne := func(name string) {
+		value, err := getParameter(ctx, client, r.retry, name)
+		record(fetchTarget{parameter: true, name: name, region: key.region, role: key.role}, fetchResult{value: value, err: err})
+	}
+
+	if len(names) == 1 {
+		fetchOne(names[0])
+		return
+	}
+
+	values, errs, err := getParameterBatch(ctx, client, r.retry, names)
+	if err != nil {
+		for _, name := range names {
+			fetchOne(name)
+		}
+		return
+	}
+
+	for _, name := range names {
+		if value, ok := values[name]; ok {
+			record(fetchTarget{parameter: true, name: name, region: key.region, role: key.role}, fetchResult{value: value})
+		} else if itemErr, ok := errs[name]; ok {
+			record(fetchTarget{parameter: true, name: name, region: key.region, role: key.role}, fetchResult{err: itemErr})
+		} else {
+			fetchOne(name)
+		}
+	}
+}
+
+// getSecretBatch retrieves several secrets with one BatchGetSecretValue call.
+//
+// Results are keyed by both the secret name and ARN so that callers can look
+// up whichever form they requested. Per-secret errors reported by AWS are
+// returned as results keyed by the requested secret ID, holding API errors
+// that carry the reported error code.
+//
+// Returns an error only if the call itself fails.
+func getSecretBatch(ctx context.Context, client secretsManagerAPI, policy retryPolicy, names []string) (map[string]fetchResult, error) {
+	results := make(map[string]fetchResult)
+
+	input := &secretsmanager.BatchGetSecretValueInput{SecretIdList: names}
+	for {
+		var resp *secretsmanager.BatchGetSecretValueOutput
+		err := policy.do(ctx, func(callCtx context.Context) error {
+			var err error
+			resp, err = client.BatchGetSecretValue(callCtx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range resp.SecretValues {
+			value, binary := secretPayload(entry.SecretString, entry.SecretBinary)
+			for _, id := range []*string{entry.Name, entry.ARN} {
+				if id != nil {
+					results[*id] = fetchResult{value: value, binary: binary}
+				}
+			}
+		}
+
+		for _, e := range resp.Errors {
+			results[aws.ToString(e.SecretId)] = fetchResult{err: &smithy.GenericAPIError{Code: aws.ToString(e.ErrorCode), Message: aws.ToString(e.Message)}}
+		}
+
+		if resp.NextToken == nil {
+			return results, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// getParameterBatch retrieves several parameters with one GetParameters call.
+//
+// Decryption is enabled for SecureString parameters. Values are keyed by the
+// parameter name plus any ":version" or ":label" selector, matching the names
+// that were requested. Names that AWS reports as invalid are returned in errs.
+//
+// Returns an error only if the call itself fails.
+func getParameterBatch(ctx context.Context, client ssmAPI, policy retryPolicy, names []string) (map[string]string, map[string]error, error) {
+	var resp *ssm.GetParametersOutput
+	err := policy.do(ctx, func(callCtx context.Context) error {
+		var err error
+		resp, err = client.GetParameters(callCtx, &ssm.GetParametersInput{
+			Names:          names,
+			WithDecryption: aws.Bool(true),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := make(map[string]string)
+	errs := make(map[string]error)
+
+	for _, p := range resp.Parameters {
+		if p.Value == nil {
+			errs[aws.ToString(p.Name)] = fmt.Errorf("parameter has no value")
+			continue
+		}
+		values[aws.ToString(p.Name)+aws.ToString(p.Selector)] = *p.Value
+		if p.ARN != nil {
+			values[*p.ARN] = *p.Value
+		}
+	}
+
+	for _, name := range resp.InvalidParameters {
+		errs[name] = &smithy.GenericAPIError{Code: "ParameterNotFound", Message: fmt.Sprintf("parameter %s not found", name)}
+	}
+
+	return values, errs, nil
+}
+
+// chunk splits names into consecutive slices of at most size elements.
+func chunk(names []string, size int) [][]string {
+	var chunks [][]string
+	for len(names) > size {
+		chunks = append(chunks, names[:size])
+		names = names[size:]
+	}
+	if len(names) > 0 {
+		chunks = append(chunks, names)
+	}
+	return chunks
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestResolverBatchesSecrets(t *testing.T) {
+	secrets := make(map[string]string)
+	var env []string
+	for i := 0; i < secretsBatchSize+5; i++ {
+		name := fmt.Sprintf("myapp/secret-%d", i)
+		secrets[name] = fmt.Sprintf("value-%d", i)
+		env = append(env, fmt.Sprintf("VAR_%d=aws-secret:%s", i, name))
+	}
+
+	sm := newFakeSecretsManager(secrets)
+	r := &resolver{secrets: sm, parallel: 4}
+
+	result, err := r.resolve(context.Background(), env)
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	if sm.batchCalls != 2 {
+		t.Errorf("BatchGetSecretValue calls = %d, want 2", sm.batchCalls)
+	}
+
+	got := envSliceToMap(result)
+	for i := 0; i < secretsBatchSize+5; i++ {
+		key := fmt.Sprintf("VAR_%d", i)
+		if want := fmt.Sprintf("value-%d", i); got[key] != want {
+			t.Errorf("%s = %q, want %q", key, got[key], want)
+		}
+	}
+}
+
+func TestResolverBatchesParameters(t *testing.T) {
+	params := make(map[string]string)
+	var env []string
+	for i := 0; i < parametersBatchSize+1; i++ {
+		name := fmt.Sprintf("/aws/reference/secretsmanager/myapp/param-%d", i)
+		params[name] = fmt.Sprintf("value-%d", i)
+		env = append(env, fmt.Sprintf("VAR_%d=aws-secret:%s", i, name))
+	}
+
+	ps := newFakeSSM(params)
+	r := &resolver{ssm: ps, parallel: 4}
+
+	result, err := r.resolve(context.Background(), env)
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	// One batch of ten plus a single leftover fetched with GetParameter.
+	if ps.batchCalls != 1 {
+		t.Errorf("GetParameters calls = %d, want 1", ps.batchCalls)
+	}
+
+	got := envSliceToMap(result)
+	for i := 0; i < parametersBatchSize+1; i++ {
+		key := fmt.Sprintf("VAR_%d", i)
+		if want := fmt.Sprintf("value-%d", i); got[key] != want {
+			t.Errorf("%s = %q, want %q", key, got[key], want)
+		}
+	}
+}
+
+func TestResolverBatchItemErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     []string
+		wantVar string
+		wantMsg string
+	}{
+		{
+			name:    "missing secret",
+			env:     []string{"GOOD=aws-secret:ok", "BAD=aws-secret:missing"},
+			wantVar: "BAD",
+			wantMsg: "ResourceNotFoundException",
+		},
+		{
+			name:    "missing parameter",
+			env:     []string{"GOOD=aws-secret:/aws/reference/secretsmanager/ok", "BAD=aws-secret:/aws/reference/secretsmanager/missing"},
+			wantVar: "BAD",
+			wantMsg: "not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &resolver{
+				secrets:  newFakeSecretsManager(map[string]string{"ok": "value"}),
+				ssm:      newFakeSSM(map[string]string{"/aws/reference/secretsmanager/ok": "value"}),
+				parallel: 2,
+			}
+
+			_, err := r.resolve(context.Background(), tt.env)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.wantVar) || !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("error = %v, want it to mention %s and %q", err, tt.wantVar, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestResolverBatchFallback(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"a": "1", "b": "2"})
+	sm.batchErr = errors.New("AccessDeniedException: not authorized to perform secretsmanager:BatchGetSecretValue")
+	r := &resolver{secrets: sm, parallel: 2}
+
+	result, err := r.resolve(context.Background(), []string{"A=aws-secret:a", "B=aws-secret:b"})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	got := envSliceToMap(result)
+	if got["A"] != "1" || got["B"] != "2" {
+		t.Errorf("resolved = %v, want A=1 B=2", got)
+	}
+	if sm.calls["a"] != 1 || sm.calls["b"] != 1 {
+		t.Errorf("GetSecretValue calls = %v, want one per secret", sm.calls)
+	}
+}
+
+func TestChunk(t *testing.T) {
+	tests := []struct {
+		n, size int
+		want    []int
+	}{
+		{0, 10, nil},
+		{1, 10, []int{1}},
+		{10, 10, []int{10}},
+		{25, 10, []int{10, 10, 5}},
+	}
+
+	for _, tt := range tests {
+		names := make([]string, tt.n)
+		chunks := chunk(names, tt.size)
+		if len(chunks) != len(tt.want) {
+			t.Errorf("chunk(%d, %d) = %d chunks, want %d", tt.n, tt.size, len(chunks), len(tt.want))
+			continue
+		}
+		for i, c := range chunks {
+			if len(c) != tt.want[i] {
+				t.Errorf("chunk(%d, %d)[%d] has %d names, want %d", tt.n, tt.size, i, len(c), tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Package main provides binary secret support.
+//
+// This file contains the functions that resolve Secrets Manager secrets
+// stored as SecretBinary, such as keystores and DER certificates, and the
+// encoding transforms shared with string secrets.
+//
+// # Binary Secrets
+//
+// A binary secret is written to a file byte for byte, or placed in a
+// variable encoded as text:
+//
+//	KEYSTORE=aws-secret-file:myapp/keystore|path=keystore.p12
+//	KEYSTORE_B64=aws-secret:myapp/keystore|encoding=base64
+//	CERT_HEX=aws-secret:myapp/cert.der|encoding=hex
+//
+// Without a file reference or encoding= a binary secret is an error, since
+// arbitrary bytes cannot be passed through the environment. Binary secrets
+// have no keys.
+//
+// # Encoded String Secrets
+//
+// decode= turns a string secret, or a key of one, that holds encoded binary
+// data back into bytes, typically for a file:
+//
+//	TLS_KEY=aws-secret-file:myapp/tls#key_base64|decode=base64|mode=0400
+//
+// Whitespace in the encoded text, such as line breaks, is ignored. A decoded
+// value containing NUL bytes must go to a file or be encoded again with
+// encoding=.
+//
+// Options:
+//   - encoding=base64|hex: encode the value, for binary or string secrets
+//   - decode=base64|hex: decode a string secret before it is used
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Supported values of the encoding= and decode= options.
+const (
+	encodingBase64 = "base64"
+	encodingHex    = "hex"
+)
+
+// validateEncoding reports an error if name is not a supported encoding.
+func validateEncoding(option, name string) error {
+	switch name {
+	case encodingBase64, encodingHex:
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q: want %s or %s", option, name, encodingBase64, encodingHex)
+}
+
+// secretPayload returns the value of a secret version, which holds either
+// a string or binary data, and whether it is binary.
+func secretPayload(secretString *string, secretBinary []byte) (string, bool) {
+	if secretString != nil {
+		return *secretString, false
+	}
+	return string(secretBinary), true
+}
+
+// binaryValue returns the value of the reference to a binary secret whose
+// raw bytes are raw.
+func (ref secretRef) binaryValue(raw string) (string, error) {
+	switch {
+	case ref.hasKey:
+		return "", fmt.Errorf("secret %s is binary, keys can only be read from string secrets", ref.name)
+	case ref.decode != "":
+		return "", fmt.Errorf("secret %s is binary, decode= applies to string secrets", ref.name)
+	case ref.encoding != "":
+		return encodeValue(ref.encoding, raw), nil
+	case ref.file.enabled:
+		return raw, nil
+	}
+	return "", fmt.Errorf("secret %s is binary: use a file reference or encoding=%s or encoding=%s", ref.name, encodingBase64, encodingHex)
+}
+
+// transform applies the decode= and encoding= options to the value of a
+// string secret, in that order.
+func (ref secretRef) transform(value string) (string, error) {
+	if ref.decode != "" {
+		decoded, err := decodeValue(ref.decode, value)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", ref.name, err)
+		}
+		if !ref.file.enabled && ref.encoding == "" && strings.ContainsRune(decoded, 0) {
+			return "", fmt.Errorf("decoded secret %s contains NUL bytes: use a file reference or encoding=", ref.name)
+		}
+		value = decoded
+	}
+
+	if ref.encoding != "" {
+		value = encodeValue(ref.encoding, value)
+	}
+	return value, nil
+}
+
+// encodeValue encodes value as text with the named encoding.
+func encodeValue(encoding, value string) string {
+	if encoding == encodingHex {
+		return hex.EncodeToString([]byte(value))
+	}
+	return base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+// decodeValue decodes text in the named encoding, ignoring whitespace. The
+// error never includes the text.
+func decodeValue(encoding, text string) (string, error) {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, text)
+
+	var decoded []byte
+	var err error
+	if encoding == encodingHex {
+		decoded, err = hex.DecodeString(text)
+	} else {
+		decoded, err = base64.StdEncoding.DecodeString(text)
+	}
+	if err != nil {
+		return "", fmt.Errorf("value is not valid %s", encoding)
+	}
+	return string(decoded), nil
+}
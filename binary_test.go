@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+// keystore is binary data that is not valid UTF-8 and contains NUL bytes.
+var keystore = []byte{0xfe, 0xed, 0xfe, 0xed, 0x00, 0x00, 0x00, 0x02}
+
+func TestResolverBinarySecrets(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/tls":  `{"key_base64":"UFJJVkFU\nRSBLRVk=","blob":"AAEC"}`,
+		"myapp/cert": "48656c6c6f",
+	})
+	sm.binary = map[string][]byte{"myapp/keystore": keystore}
+	r := &resolver{secrets: sm, parallel: 2}
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr string
+	}{
+		{name: "binary as base64", value: "aws-secret:myapp/keystore|encoding=base64", want: "/u3+7QAAAAI="},
+		{name: "binary as hex", value: "aws-secret:myapp/keystore?encoding=hex", want: "feedfeed00000002"},
+		{name: "decode base64 key", value: "aws-secret:myapp/tls#key_base64|decode=base64", want: "PRIVATE KEY"},
+		{name: "decode hex", value: "aws-secret:myapp/cert|decode=hex", want: "Hello"},
+		{name: "decode then encode", value: "aws-secret:myapp/tls#blob|decode=base64|encoding=hex", want: "000102"},
+		{name: "encode string", value: "aws-secret:myapp/cert|encoding=base64", want: "NDg2NTZjNmM2Zg=="},
+		{name: "binary without encoding", value: "aws-secret:myapp/keystore", wantErr: "secret myapp/keystore is binary: use a file reference or encoding=base64"},
+		{name: "binary with key", value: "aws-secret:myapp/keystore#password|encoding=base64", wantErr: "keys can only be read from string secrets"},
+		{name: "binary with decode", value: "aws-secret:myapp/keystore|decode=base64", wantErr: "decode= applies to string secrets"},
+		{name: "decoded NUL bytes", value: "aws-secret:myapp/tls#blob|decode=base64", wantErr: "decoded secret myapp/tls contains NUL bytes"},
+		{name: "invalid encoded text", value: "aws-secret:myapp/tls#key_base64|decode=hex", wantErr: "secret myapp/tls: value is not valid hex"},
+		{name: "unknown encoding", value: "aws-secret:myapp/keystore|encoding=base32", wantErr: `invalid encoding "base32": want base64 or hex`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := r.resolve(context.Background(), []string{"VALUE=" + tt.value})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolve() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if got := envSliceToMap(result)["VALUE"]; got != tt.want {
+				t.Errorf("VALUE = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverBinarySecretBatch(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"myapp/db": "hunter2"})
+	sm.binary = map[string][]byte{"myapp/keystore": keystore}
+	r := &resolver{secrets: sm, parallel: 2}
+
+	env := []string{
+		"DB_PASSWORD=aws-secret:myapp/db",
+		"KEYSTORE=aws-secret:myapp/keystore|encoding=hex",
+	}
+	result, err := r.resolve(context.Background(), env)
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+	if sm.batchCalls != 1 {
+		t.Errorf("batch calls = %d, want 1", sm.batchCalls)
+	}
+
+	got := envSliceToMap(result)
+	if got["DB_PASSWORD"] != "hunter2" || got["KEYSTORE"] != "feedfeed00000002" {
+		t.Errorf("resolve() = %v", got)
+	}
+}
+
+func TestResolverBinarySecretFile(t *testing.T) {
+	t.Cleanup(removeSecretFiles)
+
+	sm := newFakeSecretsManager(map[string]string{"myapp/tls": `{"key_base64":"AAEC"}`})
+	sm.binary = map[string][]byte{"myapp/keystore": keystore}
+	r := &resolver{secrets: sm, parallel: 2, secretsDir: t.TempDir()}
+
+	env := []string{
+		"KEYSTORE=aws-secret-file:myapp/keystore|path=keystore.p12",
+		"TLS_KEY=aws-secret-file:myapp/tls#key_base64|decode=base64",
+	}
+	result, err := r.resolve(context.Background(), env)
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	got := envSliceToMap(result)
+	for name, want := range map[string]string{"KEYSTORE": string(keystore), "TLS_KEY": "\x00\x01\x02"} {
+		data, err := os.ReadFile(got[name])
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(data) != want {
+			t.Errorf("%s file = %x, want %x", name, data, want)
+		}
+	}
+}
+
+func TestParseExpandDirectiveRejectsEncoding(t *testing.T) {
+	for _, value := range []string{
+		"aws-secret:myapp/prod|encoding=base64",
+		"aws-secret:myapp/prod|decode=base64",
+	} {
+		if _, err := parseExpandDirective(value, nil); err == nil {
+			t.Errorf("parseExpandDirective(%q) error = nil, want error", value)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Package main provides an encrypted on-disk cache of fetched secrets.
+//
+// This file contains the cache that lets containers start during a Secrets
+// Manager, Parameter Store or network outage by falling back to values
+// fetched by an earlier run on the same node.
+//
+// # Configuration
+//
+// The cache is enabled by -cache-dir or AWS_INIT_CACHE_DIR and needs a key,
+// either a KMS key used to generate a data key or a local key file:
+//
+//	aws-init -cache-dir /var/cache/aws-init -cache-kms-key alias/aws-init python app.py
+//	aws-init -cache-dir /var/cache/aws-init -cache-key-file /etc/aws-init/cache.key python app.py
+//
+// A key file holds 32 bytes, raw or base64 encoded. With KMS, the data key is
+// generated once and stored encrypted in the cache directory; every run
+// decrypts it with a single kms:Decrypt call. KMS calls follow the retry
+// policy and may take at most half of the time left before the resolution
+// deadline; if KMS cannot be reached by then, the cache is disabled and the
+// rest of the deadline is left for fetching secrets.
+//
+// # Policy
+//
+//   - Entries younger than -cache-ttl are served without calling AWS. The
+//     default of 0 always fetches and uses the cache only as a fallback.
+//     Watch mode refreshes after a detected change always fetch, since a
+//     fresh entry would still hold the value from before the change.
+//   - When a fetch fails with a transient error (throttling, timeout, 5xx,
+//     network), an entry up to -cache-max-stale past its TTL is served instead.
+//   - Not found and access denied errors are never masked by the cache.
+//
+// Cache hits and stale serves are logged with the secret name and age,
+// never the value.
+//
+// # Format
+//
+// Each target is stored in its own file, named by a SHA-256 hash of the
+// target so that secret names do not appear on disk. The contents are
+// sealed with AES-256-GCM, using the file name as additional data so that
+// entries cannot be swapped between targets.
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+const (
+	cacheKeySize     = 32 // AES-256
+	cacheDataKeyFile = "data-key"
+	defaultMaxStale  = 24 * time.Hour
+)
+
+// kmsAPI is the subset of the KMS client used by the cache.
+type kmsAPI interface {
+	GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// secretCache stores fetched values encrypted on disk.
+type secretCache struct {
+	dir      string
+	aead     cipher.AEAD
+	ttl      time.Duration
+	maxStale time.Duration
+	now      func() time.Time
+}
+
+// cacheEntry is the plaintext of a cache file. Binary secrets are kept in
+// Binary, since JSON strings cannot hold arbitrary bytes.
+type cacheEntry struct {
+	Value     string    `json:"value"`
+	Binary    []byte    `json:"binary,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// newSecretCache opens the cache described by opts, or returns nil if the
+// cache is disabled.
+//
+// Returns an error if the cache is misconfigured or its key cannot be
+// loaded. KMS is only called if opts names a KMS key, within the time
+// allowed by cacheKeyContext.
+func newSecretCache(ctx context.Context, client kmsAPI, opts options) (*secretCache, error) {
+	if opts.cache.dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(opts.cache.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	var key []byte
+	var err error
+	switch {
+	case opts.cache.keyFile != "" && opts.cache.kmsKey != "":
+		return nil, fmt.Errorf("cache key file and KMS key are mutually exclusive")
+	case opts.cache.keyFile != "":
+		key, err = readCacheKeyFile(opts.cache.keyFile)
+	case opts.cache.kmsKey != "":
+		keyCtx, cancel := cacheKeyContext(ctx)
+		key, err = loadDataKey(keyCtx, client, opts.retry, opts.cache.dir, opts.cache.kmsKey)
+		cancel()
+	default:
+		return nil, fmt.Errorf("cache requires a key file or a KMS key")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretCache{
+		dir:      opts.cache.dir,
+		aead:     aead,
+		ttl:      opts.cache.ttl,
+		maxStale: opts.cache.maxStale,
+		now:      time.Now,
+	}, nil
+}
+
+// readCacheKeyFile reads a 32-byte key, raw or base64 encoded.
+func readCacheKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache key: %w", err)
+	}
+	if len(data) == cacheKeySize {
+		return data, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != cacheKeySize {
+		return nil, fmt.Errorf("cache key %s must hold %d bytes, raw or base64 encoded", path, cacheKeySize)
+	}
+	return key, nil
+}
+
+// cacheKeyContext limits loading the cache key to half of the time left
+// before the deadline of ctx, so that an unreachable KMS cannot use up the
+// resolution deadline.
+func cacheKeyContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/2)
+}
+
+// loadDataKey decrypts the data key stored in dir with KMS, generating and
+// storing a new one under kmsKey on first use. Transient KMS errors are
+// retried according to policy.
+func loadDataKey(ctx context.Context, client kmsAPI, policy retryPolicy, dir, kmsKey string) ([]byte, error) {
+	path := filepath.Join(dir, cacheDataKeyFile)
+
+	blob, err := os.ReadFile(path)
+	if err == nil {
+		var resp *kms.DecryptOutput
+		err := policy.do(ctx, func(callCtx context.Context) error {
+			var err error
+			resp, err = client.Decrypt(callCtx, &kms.DecryptInput{CiphertextBlob: blob, KeyId: aws.String(kmsKey)})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt cache data key: %w", err)
+		}
+		return resp.Plaintext, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read cache data key: %w", err)
+	}
+
+	var resp *kms.GenerateDataKeyOutput
+	err = policy.do(ctx, func(callCtx context.Context) error {
+		var err error
+		resp, err = client.GenerateDataKey(callCtx, &kms.GenerateDataKeyInput{KeyId: aws.String(kmsKey), KeySpec: kmstypes.DataKeySpecAes256})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate cache data key: %w", err)
+	}
+	if err := writeCacheFile(path, resp.CiphertextBlob); err != nil {
+		return nil, err
+	}
+
+	return resp.Plaintext, nil
+}
+
+// fileName returns the cache file name for t.
+func (c *secretCache) fileName(t fetchTarget) string {
+	id := strings.Join([]string{
+		fmt.Sprint(t.parameter), fmt.Sprint(t.path), t.name, t.versionID, t.versionStage, t.region, t.role.arn,
+	}, "\x00")
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// load returns the cached value of t and its age.
+func (c *secretCache) load(t fetchTarget) (fetchResult, time.Duration, bool) {
+	name := c.fileName(t)
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return fetchResult{}, 0, false
+	}
+
+	size := c.aead.NonceSize()
+	if len(data) < size {
+		return fetchResult{}, 0, false
+	}
+	plain, err := c.aead.Open(nil, data[:size], data[size:], []byte(name))
+	if err != nil {
+		log.Printf("aws-init: ignoring unreadable cache entry for %s", t.name)
+		return fetchResult{}, 0, false
+	}
+
+	var entry cacheEntry
+	if json.Unmarshal(plain, &entry) != nil {
+		return fetchResult{}, 0, false
+	}
+
+	res := fetchResult{value: entry.Value}
+	if entry.Binary != nil {
+		res = fetchResult{value: string(entry.Binary), binary: true}
+	}
+	return res, c.now().Sub(entry.FetchedAt), true
+}
+
+// store saves the value of res as the cached value of t.
+func (c *secretCache) store(t fetchTarget, res fetchResult) error {
+	entry := cacheEntry{Value: res.value, FetchedAt: c.now()}
+	if res.binary {
+		entry = cacheEntry{Binary: []byte(res.value), FetchedAt: entry.FetchedAt}
+	}
+	plain, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	name := c.fileName(t)
+	return writeCacheFile(filepath.Join(c.dir, name), c.aead.Seal(nonce, nonce, plain, []byte(name)))
+}
+
+// fresh returns the cached value of t if it is younger than the TTL.
+func (c *secretCache) fresh(t fetchTarget) (fetchResult, bool) {
+	if c == nil || c.ttl <= 0 {
+		return fetchResult{}, false
+	}
+
+	res, age, ok := c.load(t)
+	if !ok || age >= c.ttl {
+		return fetchResult{}, false
+	}
+
+	log.Printf("aws-init: cache hit for %s (age %s)", t.name, age.Round(time.Second))
+	return res, true
+}
+
+// stale returns the cached value of t to use in place of a fetch that failed
+// with err, if err is transient and the entry is within the stale limit.
+func (c *secretCache) stale(t fetchTarget, err error) (fetchResult, bool) {
+	if c == nil || c.maxStale <= 0 || !isTransient(err) {
+		return fetchResult{}, false
+	}
+
+	res, age, ok := c.load(t)
+	if !ok || age > c.ttl+c.maxStale {
+		return fetchResult{}, false
+	}
+
+	log.Printf("aws-init: serving cached %s (age %s) after fetch failed: %s", t.name, age.Round(time.Second), errorDetail(err))
+	return res, true
+}
+
+// update records the outcome of fetching each target in results, replacing
+// failures with stale entries where allowed.
+func (c *secretCache) update(results map[fetchTarget]fetchResult) {
+	if c == nil {
+		return
+	}
+
+	for t, res := range results {
+		if res.err == nil {
+			if err := c.store(t, res); err != nil {
+				log.Printf("aws-init: warning: failed to cache %s: %v", t.name, err)
+			}
+			continue
+		}
+		if cached, ok := c.stale(t, res.err); ok {
+			results[t] = cached
+		}
+	}
+}
+
+// writeCacheFile atomically writes data to path, readable only by the owner.
+func writeCacheFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".cache-*")
+	if err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }() // no-op after a successful rename
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+
+	return nil
+}
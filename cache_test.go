@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/smithy-go"
+)
+
+// fakeKMS "encrypts" data keys by prefixing them, and counts calls. If
+// blackholed is set, calls hang until their context ends.
+type fakeKMS struct {
+	generated  int
+	decrypted  int
+	blackholed bool
+}
+
+func (f *fakeKMS) GenerateDataKey(ctx context.Context, in *kms.GenerateDataKeyInput, _ ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	f.generated++
+	if f.blackholed {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	key := bytes.Repeat([]byte{byte(f.generated)}, cacheKeySize)
+	return &kms.GenerateDataKeyOutput{Plaintext: key, CiphertextBlob: append([]byte("wrapped:"), key...)}, nil
+}
+
+func (f *fakeKMS) Decrypt(ctx context.Context, in *kms.DecryptInput, _ ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	f.decrypted++
+	if f.blackholed {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return &kms.DecryptOutput{Plaintext: bytes.TrimPrefix(in.CiphertextBlob, []byte("wrapped:"))}, nil
+}
+
+func newTestCache(t *testing.T, ttl, maxStale time.Duration) *secretCache {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "cache.key")
+	if err := os.WriteFile(keyFile, bytes.Repeat([]byte("k"), cacheKeySize), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := defaultOptions()
+	opts.cache = cacheOptions{dir: t.TempDir(), keyFile: keyFile, ttl: ttl, maxStale: maxStale}
+	c, err := newSecretCache(context.Background(), nil, opts)
+	if err != nil {
+		t.Fatalf("newSecretCache() error = %v", err)
+	}
+	return c
+}
+
+func TestReadCacheKeyFile(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, cacheKeySize)
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "raw", data: key},
+		{name: "base64", data: []byte(base64.StdEncoding.EncodeToString(key) + "\n")},
+		{name: "short", data: []byte("too short"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key")
+			if err := os.WriteFile(path, tt.data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readCacheKeyFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readCacheKeyFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(got, key) {
+				t.Errorf("readCacheKeyFile() = %x, want %x", got, key)
+			}
+		})
+	}
+}
+
+func TestSecretCacheRoundTrip(t *testing.T) {
+	c := newTestCache(t, 0, time.Hour)
+	db := fetchTarget{name: "myapp/db"}
+	other := fetchTarget{name: "myapp/other"}
+
+	if err := c.store(db, fetchResult{value: "hunter2"}); err != nil {
+		t.Fatalf("store() error = %v", err)
+	}
+	if res, _, ok := c.load(db); !ok || res.value != "hunter2" || res.binary {
+		t.Errorf("load() = %+v, %v, want hunter2", res, ok)
+	}
+	if _, _, ok := c.load(other); ok {
+		t.Error("load() of uncached target succeeded")
+	}
+
+	// Binary values survive byte for byte
+	keystore := fetchTarget{name: "myapp/keystore"}
+	if err := c.store(keystore, fetchResult{value: "\xfe\xed\x00\x02", binary: true}); err != nil {
+		t.Fatalf("store() error = %v", err)
+	}
+	if res, _, ok := c.load(keystore); !ok || res.value != "\xfe\xed\x00\x02" || !res.binary {
+		t.Errorf("load() of binary entry = %+v, %v, want raw bytes", res, ok)
+	}
+
+	// Neither the value nor the name may appear on disk
+	data, err := os.ReadFile(filepath.Join(c.dir, c.fileName(db)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("hunter2")) || bytes.Contains(data, []byte("myapp")) {
+		t.Error("cache file contains plaintext")
+	}
+
+	// An entry copied to another target's file must not decrypt
+	if err := os.WriteFile(filepath.Join(c.dir, c.fileName(other)), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.load(other); ok {
+		t.Error("load() accepted an entry moved from another target")
+	}
+}
+
+func TestSecretCacheKMSDataKey(t *testing.T) {
+	client := &fakeKMS{}
+	opts := defaultOptions()
+	opts.cache = cacheOptions{dir: t.TempDir(), kmsKey: "alias/aws-init"}
+
+	first, err := newSecretCache(context.Background(), client, opts)
+	if err != nil {
+		t.Fatalf("newSecretCache() error = %v", err)
+	}
+	if err := first.store(fetchTarget{name: "myapp/db"}, fetchResult{value: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := newSecretCache(context.Background(), client, opts)
+	if err != nil {
+		t.Fatalf("newSecretCache() error = %v", err)
+	}
+	if res, _, ok := second.load(fetchTarget{name: "myapp/db"}); !ok || res.value != "hunter2" {
+		t.Errorf("load() after reopening = %q, %v, want hunter2", res.value, ok)
+	}
+	if client.generated != 1 || client.decrypted != 1 {
+		t.Errorf("KMS calls: %d generate, %d decrypt, want 1 and 1", client.generated, client.decrypted)
+	}
+}
+
+func TestSecretCacheKMSUnreachable(t *testing.T) {
+	client := &fakeKMS{blackholed: true}
+	opts := defaultOptions()
+	opts.cache = cacheOptions{dir: t.TempDir(), kmsKey: "alias/aws-init"}
+	opts.retry = retryPolicy{maxAttempts: 2, baseDelay: time.Millisecond, callTimeout: 20 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := newSecretCache(ctx, client, opts); err == nil {
+		t.Fatal("newSecretCache() error = nil, want error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("newSecretCache() took %v, want the call timeout to apply", elapsed)
+	}
+	if client.generated != 2 {
+		t.Errorf("GenerateDataKey calls = %d, want 2 attempts", client.generated)
+	}
+
+	// Without a call timeout, half of the deadline is left for fetches
+	client.generated = 0
+	opts.retry.callTimeout = 0
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := newSecretCache(ctx, client, opts); err == nil {
+		t.Fatal("newSecretCache() error = nil, want error")
+	}
+	if ctx.Err() != nil {
+		t.Errorf("newSecretCache() used up the resolution deadline")
+	}
+}
+
+func TestResolverCacheFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		age      time.Duration
+		want     string
+		wantErr  string
+		wantCall bool
+	}{
+		{name: "fetch succeeds", want: "fresh", wantCall: true},
+		{name: "throttled serves stale", err: &smithy.GenericAPIError{Code: "ThrottlingException"}, age: 2 * time.Hour, want: "cached", wantCall: true},
+		{name: "too stale", err: &smithy.GenericAPIError{Code: "ThrottlingException"}, age: 48 * time.Hour, wantErr: "throttled", wantCall: true},
+		{name: "access denied is not masked", err: &smithy.GenericAPIError{Code: "AccessDeniedException"}, wantErr: "access denied", wantCall: true},
+		{name: "fresh entry skips fetch", age: 10 * time.Minute, want: "cached"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, 30*time.Minute, 24*time.Hour)
+			c.now = func() time.Time { return time.Now().Add(-tt.age) }
+			if err := c.store(fetchTarget{name: "myapp/db"}, fetchResult{value: "cached"}); err != nil {
+				t.Fatal(err)
+			}
+			c.now = time.Now
+			if tt.age == 0 {
+				c.ttl = 0 // always fetch
+			}
+
+			sm := newFakeSecretsManager(map[string]string{"myapp/db": "fresh"})
+			if tt.err != nil {
+				sm.errs = map[string]error{"myapp/db": tt.err}
+			}
+			r := &resolver{secrets: sm, parallel: 1, cache: c}
+
+			result, err := r.resolve(context.Background(), []string{"DB=aws-secret:myapp/db"})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("resolve() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			} else if got := envSliceToMap(result)["DB"]; got != tt.want {
+				t.Errorf("DB = %q, want %q", got, tt.want)
+			}
+
+			if called := sm.calls["myapp/db"] > 0; called != tt.wantCall {
+				t.Errorf("fetched = %v, want %v", called, tt.wantCall)
+			}
+		})
+	}
+}
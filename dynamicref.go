@@ -0,0 +1,108 @@
+// Package main provides CloudFormation dynamic reference support.
+//
+// This file contains functions that parse the {{resolve:...}} dynamic
+// reference grammar of CloudFormation, so that the strings used in
+// templates, task definitions and launch templates work unchanged in
+// aws-init containers.
+//
+// # Syntax
+//
+// Secrets Manager, where every field after the secret ID is optional and
+// may be empty:
+//
+//	{{resolve:secretsmanager:secret-id:SecretString:json-key:version-stage:version-id}}
+//	{{resolve:secretsmanager:myapp/prod:SecretString:password:AWSCURRENT}}
+//	{{resolve:secretsmanager:arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/prod-AbCdEf:SecretString:password}}
+//
+// Parameter Store, with an optional version:
+//
+//	{{resolve:ssm:/myapp/feature_flag}}
+//	{{resolve:ssm-secure:/myapp/db_password:3}}
+//
+// Dynamic references may make up the whole value or appear inside it, as
+// in CloudFormation, and can be mixed with ${reference} interpolation (see
+// interpolate.go):
+//
+//	DATABASE_URL=postgres://app:{{resolve:secretsmanager:myapp/db:SecretString:password}}@db:5432/app
+//
+// ssm and ssm-secure references to the same parameter share one fetch,
+// since aws-init always decrypts SecureString parameters.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	dynamicRefPrefix = "{{resolve:"
+	dynamicRefSuffix = "}}"
+)
+
+// secretStringField is the only secret field CloudFormation supports.
+const secretStringField = "SecretString"
+
+// parseDynamicRef parses the body of a dynamic reference, the text between
+// "{{resolve:" and "}}".
+//
+// Returns an error for unknown services, fields or an empty secret ID or
+// parameter name.
+func parseDynamicRef(body string) (secretRef, error) {
+	service, rest, _ := strings.Cut(body, ":")
+	switch service {
+	case "secretsmanager":
+		return parseDynamicSecretRef(rest)
+	case "ssm", "ssm-secure":
+		if rest == "" {
+			return secretRef{}, fmt.Errorf("empty parameter name in dynamic reference")
+		}
+		// name:version is the native SSM selector syntax
+		return secretRef{name: rest, parameter: true, region: arnRegion(rest)}, nil
+	default:
+		return secretRef{}, fmt.Errorf("unsupported dynamic reference service %q", service)
+	}
+}
+
+// parseDynamicSecretRef parses the fields of a secretsmanager dynamic
+// reference: secret-id[:SecretString[:json-key[:version-stage[:version-id]]]].
+func parseDynamicSecretRef(body string) (secretRef, error) {
+	fields := strings.Split(body, ":")
+
+	// A secret ARN spans several fields
+	idFields := 1
+	if fields[0] == "arn" {
+		idFields = arnFields
+	}
+	if len(fields) < idFields || fields[idFields-1] == "" {
+		return secretRef{}, fmt.Errorf("empty secret ID in dynamic reference")
+	}
+	if len(fields) > idFields+4 {
+		return secretRef{}, fmt.Errorf("dynamic reference to %s has too many fields", strings.Join(fields[:idFields], ":"))
+	}
+
+	parsed := secretRef{name: strings.Join(fields[:idFields], ":")}
+	if fields[0] == "arn" {
+		if _, err := parseSecretARN(parsed.name); err != nil {
+			return secretRef{}, err
+		}
+		parsed.region = arnRegion(parsed.name)
+	}
+
+	extra := append(fields[idFields:], "", "", "", "")
+	if field := extra[0]; field != "" && field != secretStringField {
+		return secretRef{}, fmt.Errorf("unsupported secret field %q in dynamic reference, only %s", field, secretStringField)
+	}
+	if key := extra[1]; key != "" {
+		parsed.key = key
+		parsed.hasKey = true
+	}
+	parsed.versionStage = extra[2]
+	parsed.versionID = extra[3]
+
+	return parsed, nil
+}
+
+// containsDynamicRef reports whether value contains a dynamic reference.
+func containsDynamicRef(value string) bool {
+	return strings.Contains(value, dynamicRefPrefix)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseDynamicRef(t *testing.T) {
+	const arn = "arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/prod-AbCdEf"
+
+	tests := []struct {
+		name    string
+		body    string
+		want    secretRef
+		wantErr bool
+	}{
+		{
+			name: "secret",
+			body: "secretsmanager:myapp/prod",
+			want: secretRef{name: "myapp/prod"},
+		},
+		{
+			name: "json key and stage",
+			body: "secretsmanager:myapp/prod:SecretString:password:AWSCURRENT",
+			want: secretRef{name: "myapp/prod", key: "password", hasKey: true, versionStage: "AWSCURRENT"},
+		},
+		{
+			name: "empty fields",
+			body: "secretsmanager:myapp/prod:SecretString:::01234567-89ab-cdef-0123-456789abcdef",
+			want: secretRef{name: "myapp/prod", versionID: "01234567-89ab-cdef-0123-456789abcdef"},
+		},
+		{
+			name: "secret arn",
+			body: "secretsmanager:" + arn + ":SecretString:password",
+			want: secretRef{name: arn, key: "password", hasKey: true, region: "us-east-1"},
+		},
+		{
+			name: "ssm",
+			body: "ssm:/myapp/feature_flag",
+			want: secretRef{name: "/myapp/feature_flag", parameter: true},
+		},
+		{
+			name: "ssm-secure with version",
+			body: "ssm-secure:/myapp/db_password:3",
+			want: secretRef{name: "/myapp/db_password:3", parameter: true},
+		},
+		{name: "unknown service", body: "s3:bucket/key", wantErr: true},
+		{name: "binary field", body: "secretsmanager:myapp/prod:SecretBinary", wantErr: true},
+		{name: "empty secret", body: "secretsmanager:", wantErr: true},
+		{name: "empty parameter", body: "ssm:", wantErr: true},
+		{name: "too many fields", body: "secretsmanager:myapp/prod:SecretString:a:b:c:d", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDynamicRef(tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDynamicRef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseDynamicRef() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverDynamicReferences(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/db":             `{"password":"hunter2"}`,
+		"myapp/db:AWSPREVIOUS": `{"password":"old"}`,
+	})
+	params := newFakeSSM(map[string]string{"/myapp/token": "t0ken"})
+	r := &resolver{secrets: sm, ssm: params, parallel: 2}
+
+	result, err := r.resolve(context.Background(), []string{
+		"PASSWORD={{resolve:secretsmanager:myapp/db:SecretString:password}}",
+		"OLD={{resolve:secretsmanager:myapp/db:SecretString:password:AWSPREVIOUS}}",
+		"URL=postgres://app:{{resolve:secretsmanager:myapp/db:SecretString:password}}@db/${aws-ssm:/myapp/token}",
+		"TOKEN={{resolve:ssm:/myapp/token}}",
+		"SECURE_TOKEN={{resolve:ssm-secure:/myapp/token}}",
+		"PLAIN={{not a reference}}",
+	})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	got := envSliceToMap(result)
+	want := map[string]string{
+		"PASSWORD":     "hunter2",
+		"OLD":          "old",
+		"URL":          "postgres://app:hunter2@db/t0ken",
+		"TOKEN":        "t0ken",
+		"SECURE_TOKEN": "t0ken",
+		"PLAIN":        "{{not a reference}}",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if n := params.calls["/myapp/token"]; n != 1 {
+		t.Errorf("/myapp/token fetched %d times, want 1", n)
+	}
+}
+
+func TestResolverDynamicReferenceErrors(t *testing.T) {
+	tests := []string{
+		"X={{resolve:secretsmanager:myapp/db",
+		"X={{resolve:dynamodb:table}}",
+	}
+
+	for _, e := range tests {
+		t.Run(e, func(t *testing.T) {
+			r := &resolver{secrets: newFakeSecretsManager(nil), ssm: newFakeSSM(nil), parallel: 1}
+			if _, err := r.resolve(context.Background(), []string{e}); err == nil {
+				t.Error("resolve() succeeded, want error")
+			}
+		})
+	}
+}
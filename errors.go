@@ -0,0 +1,221 @@
+// Package main provides error classification and reporting for secret
+// resolution.
+//
+// This file contains helpers that tell "the secret, parameter or key does
+// not exist" apart from every other failure. Only the former is eligible for
+// the optional and default= reference options; access denied, network and
+// throttling errors stay fatal unless a reference also sets ignore-errors.
+//
+// # Error Reports
+//
+// Resolution attempts every reference before giving up and returns a single
+// report with one line per failure:
+//
+//	failed to resolve 2 references:
+//	  DB_PASSWORD: aws-secret:myapp/db#password: key missing: key password not found in secret myapp/db
+//	  API_KEY: aws-ssm:/myapp/api_key: access denied: AccessDeniedException: User is not authorized
+//
+// Each line names the variable, the reference without its options and a
+// classified cause. Reports never include secret values or defaults.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go"
+)
+
+// Causes reported for failed references.
+const (
+	causeNotFound     = "not found"
+	causeAccessDenied = "access denied"
+	causeKeyMissing   = "key missing"
+	causeInvalidJSON  = "invalid JSON"
+	causeThrottled    = "throttled"
+	causeTimeout      = "timeout"
+	causeInvalid      = "invalid reference"
+	causeOther        = "error"
+)
+
+// keyNotFoundError reports a JSON key or path that is missing from a secret.
+type keyNotFoundError struct {
+	key  string
+	name string
+}
+
+func (e *keyNotFoundError) Error() string {
+	return fmt.Sprintf("key %s not found in secret %s", e.key, e.name)
+}
+
+// invalidJSONError reports a secret that is not valid JSON, or not a JSON
+// object when one is required. It never includes the offending value.
+type invalidJSONError struct {
+	name   string
+	object bool
+}
+
+func (e *invalidJSONError) Error() string {
+	if e.object {
+		return fmt.Sprintf("secret %s is not a JSON object", e.name)
+	}
+	return fmt.Sprintf("secret %s is not valid JSON", e.name)
+}
+
+// deadlineError reports a reference that was still being fetched when the
+// resolution deadline passed.
+type deadlineError struct {
+	err error
+}
+
+func (e *deadlineError) Error() string {
+	return "still outstanding when the resolution deadline passed"
+}
+
+func (e *deadlineError) Unwrap() error {
+	return e.err
+}
+
+// resolveError is the failure of one reference in one variable.
+type resolveError struct {
+	variable string
+	ref      string // reference without options, empty if it did not parse
+	err      error
+}
+
+func (e *resolveError) Error() string {
+	if e.ref == "" {
+		return fmt.Sprintf("%s: %s: %s", e.variable, causeInvalid, errorDetail(e.err))
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", e.variable, e.ref, classify(e.err), errorDetail(e.err))
+}
+
+func (e *resolveError) Unwrap() error {
+	return e.err
+}
+
+// resolveErrors is the combined report returned when any reference fails.
+type resolveErrors []*resolveError
+
+func (errs resolveErrors) Error() string {
+	if len(errs) == 1 {
+		return "failed to resolve " + errs[0].Error()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "failed to resolve %d references:", len(errs))
+	for _, e := range errs {
+		b.WriteString("\n  ")
+		b.WriteString(e.Error())
+	}
+	return b.String()
+}
+
+func (errs resolveErrors) Unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, e := range errs {
+		unwrapped[i] = e
+	}
+	return unwrapped
+}
+
+// errorReport collects resolution errors and reports them in env order.
+type errorReport struct {
+	order map[string]int
+	errs  resolveErrors
+}
+
+// newErrorReport returns an empty report for the variables in env.
+func newErrorReport(env []string) *errorReport {
+	order := make(map[string]int, len(env))
+	for i, e := range env {
+		name, _, _ := strings.Cut(e, "=")
+		order[name] = i
+	}
+	return &errorReport{order: order}
+}
+
+// add records that ref, used by variable, failed with err. ref may be empty
+// when the reference could not be parsed.
+func (r *errorReport) add(variable, ref string, err error) {
+	r.errs = append(r.errs, &resolveError{variable: variable, ref: ref, err: err})
+}
+
+// err returns the combined report, or nil if nothing failed.
+func (r *errorReport) err() error {
+	if len(r.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(r.errs, func(i, j int) bool {
+		return r.order[r.errs[i].variable] < r.order[r.errs[j].variable]
+	})
+	return r.errs
+}
+
+// isNotFound reports whether err means the referenced secret, parameter,
+// version or key does not exist.
+func isNotFound(err error) bool {
+	switch classify(err) {
+	case causeNotFound, causeKeyMissing:
+		return true
+	}
+	return false
+}
+
+// classify returns the cause reported for err.
+func classify(err error) string {
+	var keyErr *keyNotFoundError
+	if errors.As(err, &keyErr) {
+		return causeKeyMissing
+	}
+
+	var jsonErr *invalidJSONError
+	if errors.As(err, &jsonErr) {
+		return causeInvalidJSON
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := apiErr.ErrorCode()
+		switch code {
+		case "ResourceNotFoundException", "ParameterNotFound", "ParameterVersionNotFound":
+			return causeNotFound
+		case "AccessDeniedException", "AccessDenied", "UnauthorizedOperation",
+			"DecryptionFailure", "KMSAccessDeniedException":
+			return causeAccessDenied
+		case "RequestTimeout", "RequestTimeoutException":
+			return causeTimeout
+		}
+		if _, ok := awsretry.DefaultThrottleErrorCodes[code]; ok {
+			return causeThrottled
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return causeTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return causeTimeout
+	}
+
+	return causeOther
+}
+
+// errorDetail returns a short description of err, reducing AWS API errors
+// to their code and message.
+func errorDetail(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if msg := apiErr.ErrorMessage(); msg != "" {
+			return apiErr.ErrorCode() + ": " + msg
+		}
+		return apiErr.ErrorCode()
+	}
+	return err.Error()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestIsNotFound(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"secret", &smithy.GenericAPIError{Code: "ResourceNotFoundException"}, true},
+		{"parameter", &smithy.GenericAPIError{Code: "ParameterNotFound"}, true},
+		{"parameter version", &smithy.GenericAPIError{Code: "ParameterVersionNotFound"}, true},
+		{"key", &keyNotFoundError{key: "password", name: "myapp/db"}, true},
+		{"wrapped", fmt.Errorf("failed after 3 retries: %w", &smithy.GenericAPIError{Code: "ParameterNotFound"}), true},
+		{"access denied", &smithy.GenericAPIError{Code: "AccessDeniedException"}, false},
+		{"other", errors.New("connection reset"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNotFound(tt.err); got != tt.want {
+				t.Errorf("isNotFound(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&smithy.GenericAPIError{Code: "ResourceNotFoundException"}, causeNotFound},
+		{&smithy.GenericAPIError{Code: "AccessDeniedException"}, causeAccessDenied},
+		{&smithy.GenericAPIError{Code: "ThrottlingException"}, causeThrottled},
+		{&keyNotFoundError{key: "password", name: "myapp/db"}, causeKeyMissing},
+		{&invalidJSONError{name: "myapp/db"}, causeInvalidJSON},
+		{fmt.Errorf("get: %w", context.DeadlineExceeded), causeTimeout},
+		{errors.New("connection reset"), causeOther},
+	}
+
+	for _, tt := range tests {
+		if got := classify(tt.err); got != tt.want {
+			t.Errorf("classify(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestResolverErrorReport(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/db":  `{"user":"app"}`,
+		"myapp/raw": "hunter2",
+	})
+	sm.errs = map[string]error{"myapp/denied": &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized"}}
+	r := &resolver{secrets: sm, parallel: 2}
+
+	_, err := r.resolve(context.Background(), []string{
+		"MISSING=aws-secret:myapp/missing",
+		"KEY=aws-secret:myapp/db#password|default",
+		"PASSWORD=aws-secret:myapp/db#password",
+		"DENIED=aws-secret:myapp/denied",
+		"NOT_JSON=aws-secret:myapp/raw#password",
+		"URL=postgres://${aws-secret:myapp/db#user}:${aws-secret:myapp/raw#a}@${aws-secret:myapp/missing}",
+		"AWS_INIT_EXPAND_X=aws-secret:myapp/raw",
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	want := `failed to resolve 8 references:
+  MISSING: aws-secret:myapp/missing: not found: ResourceNotFoundException: Secrets Manager can't find the specified secret.
+  KEY: invalid reference: column 30: option default requires a value (use default= for empty)
+  PASSWORD: aws-secret:myapp/db#password: key missing: key password not found in secret myapp/db
+  DENIED: aws-secret:myapp/denied: access denied: AccessDeniedException: not authorized
+  NOT_JSON: aws-secret:myapp/raw#password: invalid JSON: secret myapp/raw is not valid JSON
+  URL: aws-secret:myapp/raw#a: invalid JSON: secret myapp/raw is not valid JSON
+  URL: aws-secret:myapp/missing: not found: ResourceNotFoundException: Secrets Manager can't find the specified secret.
+  AWS_INIT_EXPAND_X: aws-secret:myapp/raw: invalid JSON: secret myapp/raw is not a JSON object`
+	if got := err.Error(); got != want {
+		t.Errorf("error =\n%s\nwant\n%s", got, want)
+	}
+
+	if strings.Contains(err.Error(), "hunter2") || strings.Contains(err.Error(), `"app"`) {
+		t.Errorf("error = %v, contains a secret value", err)
+	}
+}
+
+func TestParseSecretRefOptions(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    secretRef
+		wantErr bool
+	}{
+		{ref: "aws-secret:myapp/db#password|optional", want: secretRef{name: "myapp/db", key: "password", hasKey: true, optional: true}},
+		{ref: "aws-ssm:/myapp/port|default=5432", want: secretRef{name: "/myapp/port", parameter: true, hasDefault: true, defaultValue: "5432"}},
+		{ref: "aws-secret:myapp/db|default=", want: secretRef{name: "myapp/db", hasDefault: true}},
+		{ref: "aws-secret:myapp/db|default=a=b", want: secretRef{name: "myapp/db", hasDefault: true, defaultValue: "a=b"}},
+		{ref: "aws-secret:myapp/db|ignore-errors", want: secretRef{name: "myapp/db", ignoreErrors: true}},
+		{ref: "aws-secret:myapp/db|mode=0400", wantErr: true},
+		{ref: "aws-secret:myapp/db|nope", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := parseSecretRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSecretRef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseSecretRef() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverOptionalReferences(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/db": `{"user":"app"}`,
+	})
+	ps := newFakeSSM(map[string]string{"/myapp/host": "db.internal"})
+	r := &resolver{secrets: sm, ssm: ps, parallel: 2}
+
+	result, err := r.resolve(context.Background(), []string{
+		"MISSING_SECRET=aws-secret:myapp/missing|optional",
+		"MISSING_KEY=aws-secret:myapp/db#password|optional",
+		"DEFAULT_KEY=aws-secret:myapp/db#password|default=changeme",
+		"DEFAULT_PARAM=aws-ssm:/myapp/port|default=5432",
+		"EMPTY_DEFAULT=aws-secret:myapp/missing|default=",
+		"PRESENT=aws-secret:myapp/db#user|default=nobody",
+		"AWS_INIT_EXPAND_MISSING=aws-secret:myapp/missing|optional",
+		"URL=postgres://${aws-secret:myapp/db#user}:${aws-secret:myapp/db#password|default=x}@${aws-ssm:/myapp/host}:${aws-ssm:/myapp/port|optional}",
+	})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	got := envSliceToMap(result)
+	want := map[string]string{
+		"DEFAULT_KEY":   "changeme",
+		"DEFAULT_PARAM": "5432",
+		"EMPTY_DEFAULT": "",
+		"PRESENT":       "app",
+		"URL":           "postgres://app:x@db.internal:",
+	}
+	for k, v := range want {
+		if value, ok := got[k]; !ok || value != v {
+			t.Errorf("%s = %q (set %v), want %q", k, value, ok, v)
+		}
+	}
+	for _, k := range []string{"MISSING_SECRET", "MISSING_KEY"} {
+		if _, ok := got[k]; ok {
+			t.Errorf("%s is set, want unset", k)
+		}
+	}
+}
+
+func TestResolverOptionalKeepsOtherErrorsFatal(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{"optional", "aws-secret:myapp/denied|optional", false},
+		{"default", "aws-secret:myapp/denied|default=x", false},
+		{"ignore-errors", "aws-secret:myapp/denied|ignore-errors|default=x", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := newFakeSecretsManager(nil)
+			sm.errs = map[string]error{"myapp/denied": &smithy.GenericAPIError{Code: "AccessDeniedException"}}
+			r := &resolver{secrets: sm, parallel: 1}
+
+			_, err := r.resolve(context.Background(), []string{"VALUE=" + tt.value})
+			if (err == nil) != tt.want {
+				t.Errorf("resolve() error = %v, want success %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverDeadlineNamesOutstandingReferences(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"fast": "value"})
+	sm.hang = map[string]bool{"slow": true}
+	r := &resolver{secrets: sm, parallel: 2, retry: retryPolicy{maxAttempts: 3, callTimeout: time.Hour}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := r.resolve(ctx, []string{
+		"FAST=aws-secret:fast",
+		"SLOW=aws-secret:slow",
+	})
+
+	want := "failed to resolve SLOW: aws-secret:slow: timeout: still outstanding when the resolution deadline passed"
+	if err == nil || err.Error() != want {
+		t.Errorf("resolve() error = %v, want %q", err, want)
+	}
+}
@@ -16,6 +16,12 @@
 //  2. Wait up to 10 seconds for graceful shutdown
 //  3. Send SIGKILL if process hasn't exited
 //
+// # Restarts
+//
+// In watch mode (see watch.go) the child is restarted when a referenced
+// secret changes: it receives SIGTERM through the same graceful shutdown
+// path and is started again with the refreshed environment.
+//
 // # Process Groups
 //
 // Child processes are started in their own process group to ensure
@@ -23,10 +29,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -43,6 +52,8 @@ const gracefulTimeout = 10 * time.Second
 //   - command: the executable to run
 //   - args: command line arguments
 //   - env: environment variables for the process
+//   - label: how the process is named in the "started" log line, which must
+//     not reveal secrets in args (see describeCommand)
 //
 // Returns the exit code of the child process, or 1 if execution fails.
 //
@@ -50,27 +61,26 @@ const gracefulTimeout = 10 * time.Second
 //   - 0: successful execution
 //   - 1: execution failed or process start error
 //   - other: exit code from child process
-func execute(command string, args []string, env []string) int {
-	cmd := exec.Command(command, args...)
-	cmd.Env = env
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-	if err := cmd.Start(); err != nil {
-		log.Printf("failed to start %s: %v", command, err)
-		return 1
-	}
-
-	if cmd.Process == nil {
-		log.Printf("no process information available")
-		return 1
-	}
-
-	pid := cmd.Process.Pid
-	log.Printf("started %s (PID %d)", command, pid)
+func execute(command string, args []string, env []string, label string) int {
+	return supervise(command, args, env, label, nil, nil)
+}
 
+// supervise runs a command like execute and, whenever a new environment is
+// received on restarts, stops the child through the same graceful SIGTERM
+// shutdown used for forwarded signals and starts it again with that
+// environment.
+//
+// Signals received on reloads are sent to the running child with
+// forwardSignal, for applications that reload their configuration in place.
+//
+// A restart requested while the child is already stopping for an earlier
+// one replaces that restart's environment, so the newest environment wins.
+// A restart requested after a termination signal has been forwarded is
+// ignored, so aws-init exits with the child as it would without restarts.
+// Nil channels never request anything.
+//
+// Returns the exit code of the last child process, or 1 if execution fails.
+func supervise(command string, args []string, env []string, label string, restarts <-chan []string, reloads <-chan os.Signal) int {
 	// Set up signal handling
 	sigChan := make(chan os.Signal, 1)
 
@@ -83,26 +93,92 @@ func execute(command string, args []string, env []string) int {
 		syscall.SIGUSR2,
 	)
 
-	// Start signal handler
-	go handleSignals(sigChan, pid)
+	// Stop signal notifications
+	defer signal.Stop(sigChan)
 
-	// Wait for process to complete
-	err := cmd.Wait()
+	stopping := false
+	for {
+		cmd := exec.Command(command, args...)
+		cmd.Env = env
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Stdin = os.Stdin
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	// Stop signal notifications
-	signal.Stop(sigChan)
+		if err := cmd.Start(); err != nil {
+			log.Printf("failed to start %s: %v", command, err)
+			return 1
+		}
+
+		if cmd.Process == nil {
+			log.Printf("no process information available")
+			return 1
+		}
+
+		pid := cmd.Process.Pid
+		log.Printf("started %s (PID %d)", label, pid)
+
+		// Start signal handler
+		childSigs := make(chan os.Signal, 1)
+		go handleSignals(childSigs, pid)
+
+		// Wait for process to complete
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
 
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
-				return status.ExitStatus()
+		restarting := false
+		var err error
+	wait:
+		for {
+			select {
+			case sig := <-sigChan:
+				switch sig {
+				case syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT:
+					stopping = true
+				}
+				childSigs <- sig
+
+			case newEnv := <-restarts:
+				if stopping {
+					continue
+				}
+				env = newEnv
+				if restarting {
+					continue
+				}
+				log.Printf("restarting %s (PID %d) with refreshed secrets", command, pid)
+				restarting = true
+				childSigs <- syscall.SIGTERM
+
+			case sig := <-reloads:
+				if stopping || restarting {
+					continue
+				}
+				log.Printf("sending %v to PID %d to reload refreshed secrets", sig, pid)
+				forwardSignal(pid, sig)
+
+			case err = <-done:
+				break wait
 			}
 		}
-		log.Printf("process failed: %v", err)
-		return 1
-	}
+		close(childSigs)
+
+		if restarting && !stopping {
+			continue
+		}
+
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+					return status.ExitStatus()
+				}
+			}
+			log.Printf("process failed: %v", err)
+			return 1
+		}
 
-	return 0
+		return 0
+	}
 }
 
 // handleSignals manages signal forwarding and graceful shutdown for child processes.
@@ -116,17 +192,25 @@ func execute(command string, args []string, env []string) int {
 //   - SIGUSR1, SIGUSR2: forwarded directly
 //   - others: ignored with log message
 //
-// The sigChan should be closed by the caller when signal handling is no longer needed.
+// The sigChan should be closed by the caller once the child has exited; this
+// also cancels a pending force kill.
 func handleSignals(sigChan chan os.Signal, pid int) {
+	var killTimer *time.Timer
+	defer func() {
+		// The child has exited, so its PID may be reused
+		if killTimer != nil {
+			killTimer.Stop()
+		}
+	}()
+
 	for sig := range sigChan {
 		switch sig {
 		case syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT:
 			log.Printf("forwarding signal %v to PID %d", sig, pid)
 			forwardSignal(pid, sig)
 
-			if sig == syscall.SIGTERM {
-				go func() {
-					time.Sleep(gracefulTimeout)
+			if sig == syscall.SIGTERM && killTimer == nil {
+				killTimer = time.AfterFunc(gracefulTimeout, func() {
 					log.Printf("graceful timeout expired, force killing PID %d", pid)
 					if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
 						log.Printf("failed to SIGKILL PID %d: %v", pid, err)
@@ -134,7 +218,7 @@ func handleSignals(sigChan chan os.Signal, pid int) {
 					if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
 						log.Printf("failed to SIGKILL group -%d: %v", pid, err)
 					}
-				}()
+				})
 			}
 
 		case syscall.SIGUSR1, syscall.SIGUSR2:
@@ -147,6 +231,29 @@ func handleSignals(sigChan chan os.Signal, pid int) {
 	}
 }
 
+// signalNames maps the names accepted by parseSignal to signals.
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// parseSignal parses a signal name such as "HUP" or "SIGUSR1", or a signal
+// number.
+func parseSignal(name string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
+
 // forwardSignal sends a signal to both a process and its process group.
 //
 // This ensures that signals reach both the direct child process and any
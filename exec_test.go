@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"syscall"
 	"testing"
@@ -57,7 +59,7 @@ func TestExecute(t *testing.T) {
 				t.Skip("skipping unix command test on windows")
 			}
 
-			code := execute(tt.command, tt.args, tt.env)
+			code := execute(tt.command, tt.args, tt.env, tt.command)
 			if code != tt.wantCode {
 				t.Errorf("execute() = %d, want %d", code, tt.wantCode)
 			}
@@ -80,7 +82,7 @@ func TestExecuteWithCustomEnv(t *testing.T) {
 	}
 
 	// Use shell to check environment variable
-	code := execute("sh", []string{"-c", "[ \"$TEST_VAR\" = \"custom_value\" ]"}, customEnv)
+	code := execute("sh", []string{"-c", "[ \"$TEST_VAR\" = \"custom_value\" ]"}, customEnv, "sh")
 	if code != 0 {
 		t.Error("custom environment variable was not set correctly")
 	}
@@ -114,7 +116,7 @@ func TestExecuteExitCodes(t *testing.T) {
 				args = []string{"-c", fmt.Sprintf("exit %d", tt.exitCode)}
 			}
 
-			code := execute(command, args, []string{"PATH=/usr/bin:/bin"})
+			code := execute(command, args, []string{"PATH=/usr/bin:/bin"}, command)
 			if code != tt.exitCode {
 				t.Errorf("execute() = %d, want %d", code, tt.exitCode)
 			}
@@ -133,7 +135,7 @@ func TestExecuteWithLongRunningProcess(t *testing.T) {
 	// This test verifies that the process execution doesn't hang
 	// We run a command that should complete quickly
 	start := time.Now()
-	code := execute("sleep", []string{"0.1"}, []string{"PATH=/usr/bin:/bin"})
+	code := execute("sleep", []string{"0.1"}, []string{"PATH=/usr/bin:/bin"}, "sleep")
 	duration := time.Since(start)
 
 	if code != 0 {
@@ -155,10 +157,25 @@ func TestForwardSignal(t *testing.T) {
 	// when called with current process PID (safe test)
 	currentPID := os.Getpid()
 
+	// Catch the signals sent to the test process, so that none is still
+	// pending when a later test forwards the signals it receives
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sigChan)
+
 	// These calls should not cause any issues
 	forwardSignal(currentPID, os.Signal(syscall.SIGUSR1))
 	forwardSignal(currentPID, os.Signal(syscall.SIGUSR2))
 
+	for received := map[os.Signal]bool{}; len(received) < 2; {
+		select {
+		case sig := <-sigChan:
+			received[sig] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v, want SIGUSR1 and SIGUSR2", received)
+		}
+	}
+
 	// Test with an obviously invalid PID should handle errors gracefully
 	forwardSignal(999999, os.Signal(syscall.SIGUSR1))
 }
@@ -181,7 +198,7 @@ func TestExecuteProcessGroupHandling(t *testing.T) {
 	`
 
 	start := time.Now()
-	code := execute("sh", []string{"-c", script}, []string{"PATH=/usr/bin:/bin"})
+	code := execute("sh", []string{"-c", script}, []string{"PATH=/usr/bin:/bin"}, "sh")
 	duration := time.Since(start)
 
 	if code != 0 {
@@ -193,3 +210,124 @@ func TestExecuteProcessGroupHandling(t *testing.T) {
 		t.Errorf("script took too long: %v", duration)
 	}
 }
+
+func TestSuperviseRestart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping process group test on windows")
+	}
+
+	out := filepath.Join(t.TempDir(), "runs")
+	script := `echo "$RUN" >> "$OUT"; [ "$RUN" = 2 ] && exit 3; exec sleep 10`
+
+	restarts := make(chan []string)
+	go func() {
+		// Wait for the first child to record its run before restarting it
+		for {
+			if data, _ := os.ReadFile(out); len(data) > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		restarts <- []string{"PATH=/usr/bin:/bin", "OUT=" + out, "RUN=2"}
+	}()
+
+	code := supervise("sh", []string{"-c", script}, []string{"PATH=/usr/bin:/bin", "OUT=" + out, "RUN=1"}, "sh", restarts, nil)
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3 from the restarted child", code)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1\n2\n" {
+		t.Errorf("runs = %q, want %q", data, "1\n2\n")
+	}
+}
+
+func TestSuperviseRestartDuringRestart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping process group test on windows")
+	}
+
+	// The first child takes a while to exit on SIGTERM, so the second
+	// restart arrives while the first is still waiting for it
+	out := filepath.Join(t.TempDir(), "runs")
+	script := `trap 'sleep 0.3; exit 0' TERM; echo "$RUN" >> "$OUT"; [ "$RUN" = 1 ] || exit 3; while :; do sleep 0.05; done`
+
+	restarts := make(chan []string)
+	go func() {
+		for {
+			if data, _ := os.ReadFile(out); len(data) > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		restarts <- []string{"PATH=/usr/bin:/bin", "OUT=" + out, "RUN=2"}
+		restarts <- []string{"PATH=/usr/bin:/bin", "OUT=" + out, "RUN=3"}
+	}()
+
+	code := supervise("sh", []string{"-c", script}, []string{"PATH=/usr/bin:/bin", "OUT=" + out, "RUN=1"}, "sh", restarts, nil)
+	if code != 3 {
+		t.Errorf("exit code = %d, want 3 from the restarted child", code)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1\n3\n" {
+		t.Errorf("runs = %q, want %q", data, "1\n3\n")
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{in: "HUP", want: syscall.SIGHUP},
+		{in: "SIGUSR1", want: syscall.SIGUSR1},
+		{in: "sigterm", want: syscall.SIGTERM},
+		{in: "10", want: syscall.Signal(10)},
+		{in: "RELOAD", wantErr: true},
+		{in: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSignal(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSignal(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSignal(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSuperviseReload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("skipping signal test on windows")
+	}
+
+	ready := filepath.Join(t.TempDir(), "ready")
+	script := `trap 'exit 7' HUP; touch "$READY"; while :; do sleep 0.05; done`
+
+	reloads := make(chan os.Signal)
+	go func() {
+		for {
+			if _, err := os.Stat(ready); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		reloads <- syscall.SIGHUP
+	}()
+
+	code := supervise("sh", []string{"-c", script}, []string{"PATH=/usr/bin:/bin", "READY=" + ready}, "sh", nil, reloads)
+	if code != 7 {
+		t.Errorf("exit code = %d, want 7 from the HUP trap", code)
+	}
+}
@@ -0,0 +1,237 @@
+// Package main provides bulk expansion of JSON secrets into environment variables.
+//
+// This file contains functions for AWS_INIT_EXPAND_* directives, which turn
+// every top-level key of a JSON secret or parameter, or every parameter under
+// a Parameter Store path, into its own variable.
+//
+// # Directive Format
+//
+//	AWS_INIT_EXPAND_<ID>=<reference>[|option...]
+//
+// The <ID> only distinguishes directives from each other. The reference uses
+// the usual aws-secret: or aws-ssm: syntax; a #path selects a nested object.
+// Options:
+//   - prefix=NAME_: prepended to every generated variable name
+//   - case=upper or case=lower: applied to the key before the prefix is added
+//   - overwrite: replace variables that are already set
+//   - optional: expand nothing if the secret, parameter or key does not exist
+//
+// Other options, such as region= or version=, apply to the reference, and
+// options may also be given as a ?query, see reference.go. default= and
+// ignore-errors are rejected, since a directive has no single value to fall
+// back to.
+//
+// Example:
+//
+//	AWS_INIT_EXPAND_MYAPP=aws-secret:myapp/prod|prefix=MYAPP_|case=upper
+//
+// With a secret of {"db_host":"db.internal","port":5432} this exports
+// MYAPP_DB_HOST=db.internal and MYAPP_PORT=5432.
+//
+// # Parameter Store Paths
+//
+// An aws-ssm: reference ending in "/" loads every parameter below that path,
+// recursively and with SecureString decryption. Each parameter's name
+// relative to the path becomes the key:
+//
+//	AWS_INIT_EXPAND_CONFIG=aws-ssm:/myapp/prod/|case=upper
+//
+// With /myapp/prod/db/host and /myapp/prod/log_level this exports DB_HOST and
+// LOG_LEVEL.
+//
+// # Naming
+//
+// Characters that are not letters, digits or underscores become underscores,
+// and a name that would start with a digit is prefixed with an underscore.
+// Directives themselves are consumed and not passed to the child process.
+// Without overwrite, a generated name that collides with any other variable
+// is an error.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+const expandPrefix = "AWS_INIT_EXPAND_"
+
+// expandDirective is a parsed AWS_INIT_EXPAND_* value.
+type expandDirective struct {
+	ref       secretRef
+	prefix    string
+	upper     bool
+	lower     bool
+	overwrite bool
+	optional  bool
+}
+
+// isExpandDirective reports whether an environment variable name is an
+// AWS_INIT_EXPAND_* directive.
+func isExpandDirective(name string) bool {
+	return strings.HasPrefix(name, expandPrefix) && len(name) > len(expandPrefix)
+}
+
+// parseExpandDirective parses the value of an AWS_INIT_EXPAND_* variable.
+func parseExpandDirective(value string, vars *plainVars) (expandDirective, error) {
+	if !isReference(value) {
+		return expandDirective{}, fmt.Errorf("expand directive must be an %s or %s reference", secretPrefix, parameterPrefix)
+	}
+
+	value, err := vars.expand(value)
+	if err != nil {
+		return expandDirective{}, err
+	}
+	syntax, err := scanReference(value)
+	if err != nil {
+		return expandDirective{}, err
+	}
+
+	// Expand options are taken here; the rest, such as region=, apply to
+	// the reference.
+	var d expandDirective
+	refOptions := syntax.options[:0:0]
+	for _, option := range syntax.options {
+		switch option.name {
+		case "prefix":
+			d.prefix = option.value
+		case "case":
+			switch option.value {
+			case "upper":
+				d.upper = true
+			case "lower":
+				d.lower = true
+			default:
+				return expandDirective{}, atColumn(option.column, fmt.Errorf("invalid case %q: want upper or lower", option.value))
+			}
+		case "overwrite":
+			d.overwrite = true
+		case "optional":
+			d.optional = true
+		case "default", "ignore-errors":
+			// There is no single value to fall back to
+			return expandDirective{}, atColumn(option.column, fmt.Errorf("option %s is not supported by expand directives, use optional", option.name))
+		default:
+			refOptions = append(refOptions, option)
+		}
+	}
+	syntax.options = refOptions
+
+	if d.ref, err = syntax.reference(); err != nil {
+		return expandDirective{}, err
+	}
+	if d.ref.file.enabled {
+		return expandDirective{}, fmt.Errorf("file references cannot be expanded")
+	}
+	if d.ref.encoding != "" || d.ref.decode != "" {
+		return expandDirective{}, fmt.Errorf("encoding= and decode= cannot be used with expand directives")
+	}
+
+	return d, nil
+}
+
+// variables converts a fetched secret value into "KEY=value" entries, sorted
+// by name.
+func (d expandDirective) variables(secretValue string) ([]string, error) {
+	value, err := d.ref.extract(secretValue)
+	if err != nil {
+		return nil, err
+	}
+
+	var members map[string]json.RawMessage
+	if json.Unmarshal([]byte(value), &members) != nil {
+		return nil, &invalidJSONError{name: d.ref.name, object: true}
+	}
+
+	vars := make([]string, 0, len(members))
+	for key, raw := range members {
+		vars = append(vars, d.envName(key)+"="+renderJSON(raw))
+	}
+	sort.Strings(vars)
+
+	return vars, nil
+}
+
+// lookup returns the directive's variables from a set of fetch results.
+func (d expandDirective) lookup(fetched map[fetchTarget]fetchResult) ([]string, error) {
+	res := fetched[d.ref.target()]
+	if res.err != nil {
+		return nil, res.err
+	}
+	if res.binary {
+		return nil, fmt.Errorf("secret %s is binary and cannot be expanded", d.ref.name)
+	}
+	return d.variables(res.value)
+}
+
+// envName maps a JSON key to an environment variable name.
+func (d expandDirective) envName(key string) string {
+	switch {
+	case d.upper:
+		key = strings.ToUpper(key)
+	case d.lower:
+		key = strings.ToLower(key)
+	}
+
+	name := []byte(d.prefix + key)
+	for i, c := range name {
+		if !(c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		return "_" + string(name)
+	}
+
+	return string(name)
+}
+
+// expandAll appends the variables generated by each directive to result.
+//
+// Directives are applied in env order. A generated name that is already
+// present in result is an error unless the directive allows overwriting, in
+// which case the existing entry is replaced in place. Errors are added to
+// report and the remaining directives are still applied.
+func expandAll(result []string, env []string, directives map[int]expandDirective, fetched map[fetchTarget]fetchResult, report *errorReport) []string {
+	index := make(map[string]int, len(result))
+	for i, e := range result {
+		name, _, _ := strings.Cut(e, "=")
+		index[name] = i
+	}
+
+	for i, e := range env {
+		d, ok := directives[i]
+		if !ok {
+			continue
+		}
+		directive, _, _ := strings.Cut(e, "=")
+
+		vars, err := d.lookup(fetched)
+		if err != nil {
+			if d.optional && isNotFound(err) {
+				log.Printf("aws-init: %s: optional %s not resolved: %v", directive, d.ref.name, err)
+				continue
+			}
+			report.add(directive, d.ref.describe(), err)
+			continue
+		}
+
+		for _, v := range vars {
+			name, _, _ := strings.Cut(v, "=")
+			if j, exists := index[name]; exists {
+				if !d.overwrite {
+					report.add(directive, d.ref.describe(), fmt.Errorf("variable %s is already set (add |overwrite to replace it)", name))
+					continue
+				}
+				result[j] = v
+				continue
+			}
+			index[name] = len(result)
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseExpandDirective(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    expandDirective
+		wantErr bool
+	}{
+		{
+			name:  "reference only",
+			value: "aws-secret:myapp/prod",
+			want:  expandDirective{ref: secretRef{name: "myapp/prod"}},
+		},
+		{
+			name:  "all options",
+			value: "aws-secret:myapp/prod|prefix=APP_|case=upper|overwrite",
+			want:  expandDirective{ref: secretRef{name: "myapp/prod"}, prefix: "APP_", upper: true, overwrite: true},
+		},
+		{
+			name:  "parameter with nested path",
+			value: "aws-ssm:/myapp/config#env|case=lower",
+			want:  expandDirective{ref: secretRef{name: "/myapp/config", key: "env", hasKey: true, parameter: true}, lower: true},
+		},
+		{
+			name:    "not a reference",
+			value:   "myapp/prod",
+			wantErr: true,
+		},
+		{
+			name:    "invalid case",
+			value:   "aws-secret:myapp/prod|case=title",
+			wantErr: true,
+		},
+		{
+			name:    "unknown option",
+			value:   "aws-secret:myapp/prod|suffix=_X",
+			wantErr: true,
+		},
+		{
+			name:    "default",
+			value:   "aws-secret:myapp/prod|default={}",
+			wantErr: true,
+		},
+		{
+			name:    "ignore-errors",
+			value:   "aws-secret:myapp/prod|optional|ignore-errors",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExpandDirective(tt.value, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExpandDirective() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseExpandDirective() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandEnvName(t *testing.T) {
+	tests := []struct {
+		d    expandDirective
+		key  string
+		want string
+	}{
+		{expandDirective{}, "db_host", "db_host"},
+		{expandDirective{upper: true}, "db-host", "DB_HOST"},
+		{expandDirective{lower: true, prefix: "APP_"}, "DB.Host", "APP_db_host"},
+		{expandDirective{}, "1st", "_1st"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.d.envName(tt.key); got != tt.want {
+			t.Errorf("envName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestResolverExpand(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/prod": `{"db_host":"db.internal","port":5432,"nested":{"a":1}}`,
+		"plain":      `not json`,
+	})
+
+	tests := []struct {
+		name     string
+		env      []string
+		wantVars map[string]string
+		wantGone []string
+		wantErr  string
+	}{
+		{
+			name: "prefix and upper case",
+			env:  []string{"AWS_INIT_EXPAND_MYAPP=aws-secret:myapp/prod|prefix=MYAPP_|case=upper", "OTHER=1"},
+			wantVars: map[string]string{
+				"MYAPP_DB_HOST": "db.internal",
+				"MYAPP_PORT":    "5432",
+				"MYAPP_NESTED":  `{"a":1}`,
+				"OTHER":         "1",
+			},
+			wantGone: []string{"AWS_INIT_EXPAND_MYAPP"},
+		},
+		{
+			name:     "nested object",
+			env:      []string{"AWS_INIT_EXPAND_N=aws-secret:myapp/prod#nested"},
+			wantVars: map[string]string{"a": "1"},
+		},
+		{
+			name:    "refuses to clobber",
+			env:     []string{"port=8080", "AWS_INIT_EXPAND_MYAPP=aws-secret:myapp/prod"},
+			wantErr: "port is already set",
+		},
+		{
+			name:     "overwrite",
+			env:      []string{"port=8080", "AWS_INIT_EXPAND_MYAPP=aws-secret:myapp/prod|overwrite"},
+			wantVars: map[string]string{"port": "5432"},
+		},
+		{
+			name:    "not an object",
+			env:     []string{"AWS_INIT_EXPAND_P=aws-secret:plain"},
+			wantErr: "not a JSON object",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &resolver{secrets: sm, parallel: 2}
+
+			result, err := r.resolve(context.Background(), tt.env)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolve() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+
+			got := envSliceToMap(result)
+			for k, v := range tt.wantVars {
+				if got[k] != v {
+					t.Errorf("%s = %q, want %q", k, got[k], v)
+				}
+			}
+			for _, k := range tt.wantGone {
+				if _, ok := got[k]; ok {
+					t.Errorf("%s should not be passed through", k)
+				}
+			}
+		})
+	}
+}
+
+func TestResolverExpandParameterPath(t *testing.T) {
+	ps := newFakeSSM(map[string]string{
+		"/myapp/prod/db/host":   "db.internal",
+		"/myapp/prod/db/port":   "5432",
+		"/myapp/prod/log_level": "debug",
+		"/myapp/prod/api-key":   "secret",
+		"/myapp/stage/db/host":  "stage.internal",
+	})
+	r := &resolver{ssm: ps, parallel: 2}
+
+	result, err := r.resolve(context.Background(), []string{
+		"AWS_INIT_EXPAND_CONFIG=aws-ssm:/myapp/prod/|case=upper",
+	})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	want := map[string]string{
+		"DB_HOST":   "db.internal",
+		"DB_PORT":   "5432",
+		"LOG_LEVEL": "debug",
+		"API_KEY":   "secret",
+	}
+	got := envSliceToMap(result)
+	if len(got) != len(want) {
+		t.Errorf("resolved %d variables, want %d: %v", len(got), len(want), got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestResolverParameterPathRequiresDirective(t *testing.T) {
+	r := &resolver{ssm: newFakeSSM(nil), parallel: 1}
+
+	_, err := r.resolve(context.Background(), []string{"CONFIG=aws-ssm:/myapp/prod/"})
+	if err == nil || !strings.Contains(err.Error(), expandPrefix) {
+		t.Errorf("resolve() error = %v, want it to point at %s", err, expandPrefix)
+	}
+}
@@ -0,0 +1,318 @@
+// Package main provides file-based secret delivery.
+//
+// This file contains functions for references that write the resolved value
+// to a file and set the environment variable to the file's path, so secrets
+// stay out of /proc/<pid>/environ and can be handed to tools that only accept
+// file paths.
+//
+// # Reference Format
+//
+//	aws-secret-file:<secret reference>[|option...]
+//	aws-ssm-file:<parameter reference>[|option...]
+//
+// Options, in addition to optional, default= and ignore-errors:
+//   - path=FILE: where to write; relative paths are inside the secrets directory
+//     and may name subdirectories, which are created (default: the variable
+//     name)
+//   - mode=0440: octal file mode (default 0400)
+//   - owner=UID[:GID]: numeric owner, for handing files to a non-root child
+//
+// Example:
+//
+//	TLS_KEY=aws-secret-file:myapp/tls#key|mode=0400|owner=1000:1000
+//	GOOGLE_APPLICATION_CREDENTIALS=aws-secret-file:myapp/gcp|path=gcp.json
+//
+// # Secrets Directory
+//
+// Files are written to a private per-run directory created under the
+// secrets directory (-secrets-dir or AWS_INIT_SECRETS_DIR). The default is
+// /dev/shm, a tmpfs on Linux, so secret material never touches a disk.
+// Files are written atomically and removed when the child process exits.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	secretFilePrefix    = "aws-secret-file:"
+	parameterFilePrefix = "aws-ssm-file:"
+	defaultFileMode     = 0o400
+	defaultSecretsDir   = "/dev/shm"
+)
+
+// fileSpec describes where and how a file reference is written.
+type fileSpec struct {
+	enabled bool
+	path    string
+	mode    os.FileMode
+	uid     int
+	gid     int
+}
+
+// secretFiles tracks everything written by file references so it can be
+// removed when the child exits.
+var secretFiles struct {
+	sync.Mutex
+	runDir string
+	paths  []string
+}
+
+// isFileReference reports whether a value is an aws-secret-file: or
+// aws-ssm-file: reference.
+func isFileReference(value string) bool {
+	return strings.HasPrefix(value, secretFilePrefix) || strings.HasPrefix(value, parameterFilePrefix)
+}
+
+// defaultFileSpec returns the file settings used when a file reference has
+// no options.
+func defaultFileSpec() fileSpec {
+	return fileSpec{enabled: true, mode: defaultFileMode, uid: -1, gid: -1}
+}
+
+// setOption applies one file option from a reference.
+func (spec *fileSpec) setOption(key, value string) error {
+	switch key {
+	case "path":
+		if value == "" {
+			return fmt.Errorf("empty file path")
+		}
+		if !filepath.IsAbs(value) && !filepath.IsLocal(value) {
+			return fmt.Errorf("file path %q leaves the secrets directory", value)
+		}
+		spec.path = value
+	case "mode":
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode > 0o777 {
+			return fmt.Errorf("invalid file mode %q", value)
+		}
+		spec.mode = os.FileMode(mode)
+	case "owner":
+		uid, gid, err := parseOwner(value)
+		if err != nil {
+			return err
+		}
+		spec.uid, spec.gid = uid, gid
+	default:
+		return fmt.Errorf("unknown reference option %q", key)
+	}
+	return nil
+}
+
+// parseOwner parses "UID" or "UID:GID". A missing GID is returned as -1,
+// which leaves the group unchanged.
+func parseOwner(s string) (int, int, error) {
+	u, g, hasGroup := strings.Cut(s, ":")
+
+	uid, err := strconv.Atoi(u)
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("invalid owner %q: want UID[:GID]", s)
+	}
+
+	gid := -1
+	if hasGroup {
+		if gid, err = strconv.Atoi(g); err != nil || gid < 0 {
+			return 0, 0, fmt.Errorf("invalid owner %q: want UID[:GID]", s)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// fileStage holds secret files that are written only once a whole
+// resolution has succeeded, so that a failed refresh leaves the files from
+// the previous one in place.
+type fileStage struct {
+	files []stagedFile
+}
+
+// stagedFile is a file waiting in a fileStage.
+type stagedFile struct {
+	path  string
+	spec  fileSpec
+	value []byte
+}
+
+// add queues value to be written to path.
+func (s *fileStage) add(path string, spec fileSpec, value []byte) {
+	s.files = append(s.files, stagedFile{path: path, spec: spec, value: value})
+}
+
+// commit writes every queued file and empties the stage.
+//
+// Returns an error naming the first file that could not be written; the
+// remaining files are still attempted.
+func (s *fileStage) commit() error {
+	var firstErr error
+	for _, f := range s.files {
+		if err := writeSecretFileAt(f.path, f.spec, f.value); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", f.path, err)
+		}
+	}
+	s.files = nil
+	return firstErr
+}
+
+// writeSecretFile writes value for the variable name according to spec and
+// returns the path that was written.
+//
+// The file is written to a temporary name and renamed into place, so readers
+// never observe a partially written secret.
+func writeSecretFile(baseDir, name string, spec fileSpec, value []byte) (string, error) {
+	path, err := secretFilePath(baseDir, name, spec)
+	if err != nil {
+		return "", err
+	}
+	if err := writeSecretFileAt(path, spec, value); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// secretFilePath returns where the file for the variable name is written.
+func secretFilePath(baseDir, name string, spec fileSpec) (string, error) {
+	path := spec.path
+	if path == "" {
+		path = name
+	}
+
+	if !filepath.IsAbs(path) {
+		dir, err := secretsRunDir(baseDir)
+		if err != nil {
+			return "", err
+		}
+		if err := makeRunSubdirs(dir, path); err != nil {
+			return "", err
+		}
+		path = filepath.Join(dir, path)
+	}
+
+	return path, nil
+}
+
+// makeRunSubdirs creates the directories of the relative path rel inside
+// the per-run directory dir, with the same permissions as dir. They are
+// removed with it.
+func makeRunSubdirs(dir, rel string) error {
+	parent := filepath.Dir(filepath.Clean(rel))
+	if parent == "." {
+		return nil
+	}
+
+	for _, part := range strings.Split(parent, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		if err := os.Mkdir(dir, 0o711); err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				continue
+			}
+			return fmt.Errorf("failed to create secrets directory: %w", err)
+		}
+		if err := os.Chmod(dir, 0o711); err != nil {
+			return fmt.Errorf("failed to create secrets directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeSecretFileAt atomically writes value to path and registers the file
+// for removal.
+func writeSecretFileAt(path string, spec fileSpec, value []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".aws-init-*")
+	if err != nil {
+		return fmt.Errorf("failed to create secret file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }() // no-op after a successful rename
+
+	err = fillSecretFile(tmp, spec, value)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write secret file: %w", err)
+	}
+
+	secretFiles.Lock()
+	if !slices.Contains(secretFiles.paths, path) {
+		secretFiles.paths = append(secretFiles.paths, path)
+	}
+	secretFiles.Unlock()
+
+	return nil
+}
+
+// fillSecretFile writes value to f and applies the mode and owner from spec.
+func fillSecretFile(f *os.File, spec fileSpec, value []byte) error {
+	if _, err := f.Write(value); err != nil {
+		return err
+	}
+	if err := f.Chmod(spec.mode); err != nil {
+		return err
+	}
+	if spec.uid >= 0 || spec.gid >= 0 {
+		return f.Chown(spec.uid, spec.gid)
+	}
+	return nil
+}
+
+// secretsRunDir returns the per-run directory under baseDir, creating it on
+// first use. The directory is traversable but not listable by other users,
+// so files handed to another owner remain readable by that owner.
+func secretsRunDir(baseDir string) (string, error) {
+	secretFiles.Lock()
+	defer secretFiles.Unlock()
+
+	if secretFiles.runDir != "" {
+		return secretFiles.runDir, nil
+	}
+
+	if baseDir == "" {
+		baseDir = defaultSecretsDir
+		if _, err := os.Stat(baseDir); err != nil {
+			baseDir = os.TempDir()
+		}
+	}
+
+	dir, err := os.MkdirTemp(baseDir, "aws-init-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+	if err := os.Chmod(dir, 0o711); err != nil {
+		return "", fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+
+	secretFiles.runDir = dir
+	return dir, nil
+}
+
+// removeSecretFiles deletes every file written by writeSecretFile and the
+// per-run secrets directory. Errors are logged but do not stop cleanup.
+func removeSecretFiles() {
+	secretFiles.Lock()
+	defer secretFiles.Unlock()
+
+	for _, path := range secretFiles.paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("aws-init: failed to remove secret file %s: %v", path, err)
+		}
+	}
+	secretFiles.paths = nil
+
+	if secretFiles.runDir != "" {
+		if err := os.RemoveAll(secretFiles.runDir); err != nil {
+			log.Printf("aws-init: failed to remove %s: %v", secretFiles.runDir, err)
+		}
+		secretFiles.runDir = ""
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFileRef(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     string
+		want    secretRef
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			ref:  "aws-secret-file:myapp/tls#key",
+			want: secretRef{name: "myapp/tls", key: "key", hasKey: true, file: fileSpec{enabled: true, mode: 0o400, uid: -1, gid: -1}},
+		},
+		{
+			name: "all options",
+			ref:  "aws-secret-file:myapp/tls|path=tls.key|mode=0440|owner=1000:2000",
+			want: secretRef{name: "myapp/tls", file: fileSpec{enabled: true, path: "tls.key", mode: 0o440, uid: 1000, gid: 2000}},
+		},
+		{
+			name: "parameter with uid only",
+			ref:  "aws-ssm-file:/myapp/kubeconfig|owner=1000",
+			want: secretRef{name: "/myapp/kubeconfig", parameter: true, file: fileSpec{enabled: true, mode: 0o400, uid: 1000, gid: -1}},
+		},
+		{
+			name: "relative path with subdirectory",
+			ref:  "aws-secret-file:myapp/tls|path=certs/tls.key",
+			want: secretRef{name: "myapp/tls", file: fileSpec{enabled: true, path: "certs/tls.key", mode: 0o400, uid: -1, gid: -1}},
+		},
+		{
+			name:    "relative path outside the secrets directory",
+			ref:     "aws-secret-file:myapp/tls|path=../tls.key",
+			wantErr: true,
+		},
+		{
+			name:    "invalid mode",
+			ref:     "aws-secret-file:myapp/tls|mode=0999",
+			wantErr: true,
+		},
+		{
+			name:    "invalid owner",
+			ref:     "aws-secret-file:myapp/tls|owner=app",
+			wantErr: true,
+		},
+		{
+			name:    "unknown option",
+			ref:     "aws-secret-file:myapp/tls|format=pem",
+			wantErr: true,
+		},
+		{
+			name:    "empty reference",
+			ref:     "aws-secret-file:",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSecretRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSecretRef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseSecretRef() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverWritesSecretFiles(t *testing.T) {
+	base := t.TempDir()
+	explicit := filepath.Join(t.TempDir(), "explicit.pem")
+	t.Cleanup(removeSecretFiles)
+
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/tls": `{"key":"-----BEGIN KEY-----","cert":"-----BEGIN CERT-----"}`,
+	})
+	r := &resolver{secrets: sm, parallel: 2, secretsDir: base}
+
+	result, err := r.resolve(context.Background(), []string{
+		"TLS_KEY=aws-secret-file:myapp/tls#key",
+		"TLS_CERT=aws-secret-file:myapp/tls#cert|path=" + explicit + "|mode=0644",
+	})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	got := envSliceToMap(result)
+
+	keyPath := got["TLS_KEY"]
+	if !strings.HasPrefix(keyPath, base) || filepath.Base(keyPath) != "TLS_KEY" {
+		t.Errorf("TLS_KEY = %q, want a file named TLS_KEY under %s", keyPath, base)
+	}
+	assertSecretFile(t, keyPath, "-----BEGIN KEY-----", 0o400)
+
+	if got["TLS_CERT"] != explicit {
+		t.Errorf("TLS_CERT = %q, want %q", got["TLS_CERT"], explicit)
+	}
+	assertSecretFile(t, explicit, "-----BEGIN CERT-----", 0o644)
+
+	removeSecretFiles()
+
+	for _, path := range []string{keyPath, explicit, filepath.Dir(keyPath)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after cleanup", path)
+		}
+	}
+}
+
+func TestResolverWritesSecretFileSubdirectory(t *testing.T) {
+	base := t.TempDir()
+	t.Cleanup(removeSecretFiles)
+
+	sm := newFakeSecretsManager(map[string]string{"myapp/tls": `{"key":"-----BEGIN KEY-----"}`})
+	r := &resolver{secrets: sm, parallel: 2, secretsDir: base}
+
+	result, err := r.resolve(context.Background(), []string{"TLS_KEY=aws-secret-file:myapp/tls#key|path=certs/tls/key.pem"})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	keyPath := envSliceToMap(result)["TLS_KEY"]
+	if !strings.HasSuffix(keyPath, filepath.Join("certs", "tls", "key.pem")) {
+		t.Errorf("TLS_KEY = %q, want a path ending in certs/tls/key.pem", keyPath)
+	}
+	assertSecretFile(t, keyPath, "-----BEGIN KEY-----", 0o400)
+
+	info, err := os.Stat(filepath.Dir(keyPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o711 {
+		t.Errorf("subdirectory mode = %o, want 711", info.Mode().Perm())
+	}
+
+	runDir := filepath.Dir(filepath.Dir(filepath.Dir(keyPath)))
+	removeSecretFiles()
+	if _, err := os.Stat(runDir); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after cleanup", runDir)
+	}
+}
+
+func assertSecretFile(t *testing.T, path, want string, mode os.FileMode) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	if string(data) != want {
+		t.Errorf("%s contains %q, want %q", path, data, want)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+	if info.Mode().Perm() != mode {
+		t.Errorf("%s mode = %o, want %o", path, info.Mode().Perm(), mode)
+	}
+}
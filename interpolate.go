@@ -0,0 +1,138 @@
+// Package main provides inline interpolation of secret references.
+//
+// This file contains functions for values that embed one or more references
+// inside other text, so that connection strings and similar values can be
+// built without a shell wrapper around the application.
+//
+// # Syntax
+//
+// A reference is written as ${<reference>} anywhere in a value:
+//
+//	DATABASE_URL=postgres://app:${aws-secret:myapp/db#password}@db:5432/app
+//	REDIS_URL=redis://:${aws-ssm:/myapp/redis/token}@${aws-ssm:/myapp/redis/host}:6379
+//
+// Only ${ followed by aws-secret:, aws-ssm:, aws-secret-file: or
+// aws-ssm-file: starts a reference; other ${...} text, such as shell-style
+// variables, is left alone. The reference ends at the first '}' that is not
+// escaped with a backslash or closing a ${VAR} inside the reference (see
+// reference.go and vars.go).
+//
+// CloudFormation dynamic references, {{resolve:...}}, are recognized in the
+// same values, see dynamicref.go.
+//
+// # Escaping
+//
+// In a value that contains at least one reference, $${ produces a literal ${.
+// Values without references are never modified.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// valuePart is either literal text or a reference within an environment value.
+type valuePart struct {
+	literal string
+	ref     secretRef
+	isRef   bool
+}
+
+// isInterpolated reports whether value embeds at least one ${reference} or
+// dynamic reference.
+func isInterpolated(value string) bool {
+	if containsDynamicRef(value) {
+		return true
+	}
+	for rest := value; ; {
+		i := strings.Index(rest, "${")
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+2:]
+		if isReference(rest) {
+			return true
+		}
+	}
+}
+
+// parseInterpolation splits value into literal text and references,
+// expanding ${VAR} within references from vars (see vars.go).
+//
+// Returns an error if a reference is unterminated or cannot be parsed.
+func parseInterpolation(value string, vars *plainVars) ([]valuePart, error) {
+	var parts []valuePart
+	var literal strings.Builder
+	addRef := func(ref secretRef) {
+		if literal.Len() > 0 {
+			parts = append(parts, valuePart{literal: literal.String()})
+			literal.Reset()
+		}
+		parts = append(parts, valuePart{ref: ref, isRef: true})
+	}
+
+	rest := value
+	for {
+		offset := len(value) - len(rest) // of rest within value, for errors
+		i := strings.Index(rest, "${")
+		if d := strings.Index(rest, dynamicRefPrefix); d >= 0 && (i < 0 || d < i) {
+			literal.WriteString(rest[:d])
+			rest = rest[d+len(dynamicRefPrefix):]
+
+			end := strings.Index(rest, dynamicRefSuffix)
+			if end < 0 {
+				return nil, atColumn(offset+d+1, fmt.Errorf("unterminated %s in value", dynamicRefPrefix))
+			}
+			ref, err := parseDynamicRef(rest[:end])
+			if err != nil {
+				return nil, atColumn(offset+d+1, err)
+			}
+			addRef(ref)
+			rest = rest[end+len(dynamicRefSuffix):]
+			continue
+		}
+		if i < 0 {
+			literal.WriteString(rest)
+			break
+		}
+
+		// $${ is an escaped, literal ${
+		if i > 0 && rest[i-1] == '$' {
+			literal.WriteString(rest[:i-1])
+			literal.WriteString("${")
+			rest = rest[i+2:]
+			continue
+		}
+
+		literal.WriteString(rest[:i])
+		rest = rest[i+2:]
+
+		if !isReference(rest) {
+			literal.WriteString("${")
+			continue
+		}
+
+		end := referenceEnd(rest)
+		if end < 0 {
+			return nil, atColumn(offset+i+1, fmt.Errorf("unterminated ${ in value"))
+		}
+
+		body, err := vars.expand(rest[:end])
+		if err != nil {
+			return nil, shiftColumn(err, offset+i+2)
+		}
+		ref, err := parseSecretRef(body)
+		if err != nil {
+			return nil, shiftColumn(err, offset+i+2)
+		}
+
+		addRef(ref)
+		rest = rest[end+1:]
+	}
+
+	if literal.Len() > 0 {
+		parts = append(parts, valuePart{literal: literal.String()})
+	}
+
+	return parts, nil
+}
@@ -0,0 +1,171 @@
+// Package main provides JSON path extraction for secret references.
+//
+// This file contains functions that walk a JSON secret value to the element
+// named by the "#key" part of a reference.
+//
+// # Path Syntax
+//
+// Dotted paths walk nested objects, and array elements are selected with a
+// numeric segment or a bracketed index:
+//
+//	aws-secret:myapp/prod#db.host
+//	aws-secret:myapp/prod#replicas.0.host
+//	aws-secret:myapp/prod#replicas[0].host
+//
+// A key that exists verbatim at the top level always wins over a dotted path,
+// so secrets with keys such as "smtp.password" keep working.
+//
+// Paths starting with "/" are JSON Pointers (RFC 6901), which can address keys
+// containing dots or brackets:
+//
+//	aws-secret:myapp/prod#/db/host
+//	aws-secret:myapp/prod#/labels/app.kubernetes.io~1name
+//
+// # Rendering
+//
+// Strings are returned without quotes, numbers and booleans as their JSON
+// literal, null as the empty string, and objects or arrays as compact JSON.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// lookupJSONPath returns the rendered value at path within the JSON document data.
+//
+// The second result is false if any segment of the path does not exist. An
+// error is returned if data is not valid JSON or the path is malformed.
+func lookupJSONPath(data []byte, path string) (string, bool, error) {
+	var root json.RawMessage
+	if err := json.Unmarshal(data, &root); err != nil {
+		return "", false, err
+	}
+
+	var segments []string
+	if strings.HasPrefix(path, "/") {
+		segments = splitJSONPointer(path)
+	} else if raw, ok := objectMember(root, path); ok {
+		return renderJSON(raw), true, nil
+	} else {
+		var err error
+		if segments, err = splitDottedPath(path); err != nil {
+			return "", false, err
+		}
+	}
+
+	current := root
+	for _, segment := range segments {
+		next, ok := child(current, segment)
+		if !ok {
+			return "", false, nil
+		}
+		current = next
+	}
+
+	return renderJSON(current), true, nil
+}
+
+// splitJSONPointer splits an RFC 6901 JSON Pointer into unescaped reference tokens.
+func splitJSONPointer(pointer string) []string {
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		token = strings.ReplaceAll(token, "~1", "/")
+		tokens[i] = strings.ReplaceAll(token, "~0", "~")
+	}
+	return tokens
+}
+
+// splitDottedPath splits a path such as "replicas[0].host" into the segments
+// "replicas", "0" and "host".
+func splitDottedPath(path string) ([]string, error) {
+	var segments []string
+	for _, part := range strings.Split(path, ".") {
+		name, rest, _ := strings.Cut(part, "[")
+		if name != "" || rest == "" {
+			segments = append(segments, name)
+		}
+
+		for rest != "" {
+			index, after, found := strings.Cut(rest, "]")
+			if !found || index == "" {
+				return nil, fmt.Errorf("invalid path %q: unterminated index", path)
+			}
+			segments = append(segments, index)
+
+			if after == "" {
+				break
+			}
+			if !strings.HasPrefix(after, "[") {
+				return nil, fmt.Errorf("invalid path %q: unexpected %q after index", path, after)
+			}
+			rest = after[1:]
+		}
+	}
+	return segments, nil
+}
+
+// child returns the member or element of raw named by segment.
+func child(raw json.RawMessage, segment string) (json.RawMessage, bool) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 {
+		return nil, false
+	}
+
+	switch trimmed[0] {
+	case '{':
+		return objectMember(trimmed, segment)
+
+	case '[':
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 {
+			return nil, false
+		}
+		var elements []json.RawMessage
+		if err := json.Unmarshal(trimmed, &elements); err != nil || index >= len(elements) {
+			return nil, false
+		}
+		return elements[index], true
+	}
+
+	return nil, false
+}
+
+// objectMember returns the member of a JSON object, or false if raw is not an
+// object or has no such member.
+func objectMember(raw json.RawMessage, name string) (json.RawMessage, bool) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return nil, false
+	}
+	value, ok := members[name]
+	return value, ok
+}
+
+// renderJSON converts a JSON value to the string placed in the environment.
+func renderJSON(raw json.RawMessage) string {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 {
+		return ""
+	}
+
+	switch trimmed[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(trimmed, &s); err == nil {
+			return s
+		}
+	case '{', '[':
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, trimmed); err == nil {
+			return buf.String()
+		}
+	case 'n':
+		return ""
+	}
+
+	return string(trimmed)
+}
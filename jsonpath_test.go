@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLookupJSONPath(t *testing.T) {
+	const doc = `{
+		"username": "app",
+		"port": 5432,
+		"ratio": 0.25,
+		"enabled": true,
+		"note": null,
+		"smtp.password": "dotted",
+		"db": {"host": "db.internal", "options": {"sslmode": "require"}},
+		"replicas": [{"host": "r0"}, {"host": "r1"}],
+		"tags": ["a", "b"],
+		"a/b": {"c~d": "escaped"}
+	}`
+
+	tests := []struct {
+		path      string
+		want      string
+		wantFound bool
+		wantErr   bool
+	}{
+		{path: "username", want: "app", wantFound: true},
+		{path: "port", want: "5432", wantFound: true},
+		{path: "ratio", want: "0.25", wantFound: true},
+		{path: "enabled", want: "true", wantFound: true},
+		{path: "note", want: "", wantFound: true},
+		{path: "smtp.password", want: "dotted", wantFound: true},
+		{path: "db.host", want: "db.internal", wantFound: true},
+		{path: "db.options", want: `{"sslmode":"require"}`, wantFound: true},
+		{path: "db", want: `{"host":"db.internal","options":{"sslmode":"require"}}`, wantFound: true},
+		{path: "replicas.1.host", want: "r1", wantFound: true},
+		{path: "replicas[0].host", want: "r0", wantFound: true},
+		{path: "tags", want: `["a","b"]`, wantFound: true},
+		{path: "tags[1]", want: "b", wantFound: true},
+		{path: "/db/host", want: "db.internal", wantFound: true},
+		{path: "/a~1b/c~0d", want: "escaped", wantFound: true},
+		{path: "/replicas/0/host", want: "r0", wantFound: true},
+		{path: "missing"},
+		{path: "db.missing"},
+		{path: "replicas.5.host"},
+		{path: "replicas.x"},
+		{path: "username.length"},
+		{path: "tags[1", wantErr: true},
+		{path: "tags[1]x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, found, err := lookupJSONPath([]byte(doc), tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookupJSONPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if found != tt.wantFound {
+				t.Fatalf("lookupJSONPath() found = %v, want %v", found, tt.wantFound)
+			}
+			if got != tt.want {
+				t.Errorf("lookupJSONPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverNestedJSON(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"rds/prod": `{"engine":"postgres","host":"db.internal","port":5432,"dbInstanceIdentifier":"prod"}`,
+		"not-json": `plain`,
+	})
+	r := &resolver{secrets: sm, parallel: 2}
+
+	result, err := r.resolve(context.Background(), []string{
+		"DB_HOST=aws-secret:rds/prod#host",
+		"DB_PORT=aws-secret:rds/prod#port",
+	})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	got := envSliceToMap(result)
+	if got["DB_HOST"] != "db.internal" || got["DB_PORT"] != "5432" {
+		t.Errorf("resolved = %v, want DB_HOST=db.internal DB_PORT=5432", got)
+	}
+
+	if _, err := r.resolve(context.Background(), []string{"BAD=aws-secret:not-json#key"}); err == nil {
+		t.Error("expected error for key lookup in non-JSON secret")
+	}
+}
@@ -6,16 +6,40 @@
 //
 // # Usage
 //
-//	aws-init command [args...]
+//	aws-init [flags] command [args...]
 //	aws-init -v
 //	aws-init -h
 //
 // # Environment Variables
 //
-// Environment variables with aws-secret: prefixes are resolved at startup:
+// Environment variables with aws-secret: or aws-ssm: prefixes are resolved at startup:
 //
 //	DATABASE_URL=aws-secret:myapp/prod#database_url
 //	API_KEY=aws-secret:/aws/reference/secretsmanager/myapp/token
+//	FEATURE_FLAG=aws-ssm:/myapp/prod/feature_flag
+//
+// # Flags
+//
+//	-parallel n            maximum concurrent AWS API calls (env AWS_INIT_PARALLEL, default 8)
+//	-secrets-dir dir       base directory for secret files (env AWS_INIT_SECRETS_DIR, default /dev/shm)
+//	-template src[:dst]    render a config template before starting (repeatable, env AWS_INIT_TEMPLATES)
+//	-retry-max-attempts n  attempts per AWS API call (env AWS_INIT_RETRY_MAX_ATTEMPTS, default 3)
+//	-retry-base-delay d    backoff before the first retry (env AWS_INIT_RETRY_BASE_DELAY, default 100ms)
+//	-retry-max-delay d     maximum backoff between retries, 0 for no cap (env AWS_INIT_RETRY_MAX_DELAY, default 5s)
+//	-call-timeout d        timeout for each AWS API call attempt (env AWS_INIT_CALL_TIMEOUT, default 10s)
+//	-resolve-timeout d     deadline for resolution and templates (env AWS_INIT_RESOLVE_TIMEOUT, default 60s)
+//	-watch-interval d      restart the child when secrets change, polling every d (env AWS_INIT_WATCH_INTERVAL)
+//	-watch-jitter d        maximum random delay added to each poll (env AWS_INIT_WATCH_JITTER, default 30s)
+//	-watch-signal sig      on change, rewrite files and send sig instead of restarting (env AWS_INIT_WATCH_SIGNAL)
+//	-cache-dir dir         encrypted cache for outage fallback (env AWS_INIT_CACHE_DIR)
+//	-cache-key-file path   file holding the 32-byte cache key (env AWS_INIT_CACHE_KEY_FILE)
+//	-cache-kms-key id      KMS key protecting the cache data key (env AWS_INIT_CACHE_KMS_KEY)
+//	-cache-ttl d           serve cached values younger than d without fetching (env AWS_INIT_CACHE_TTL, default 0)
+//	-cache-max-stale d     serve stale values up to d past the TTL when AWS fails (env AWS_INIT_CACHE_MAX_STALE, default 24h)
+//	-fallback-region r     region to try after a transient failure (repeatable, env AWS_INIT_FALLBACK_REGIONS)
+//	-role-session-name s   session name for roles assumed by references (env AWS_INIT_ROLE_SESSION_NAME, default aws-init)
+//	-resolve-args          resolve references in the child's arguments (env AWS_INIT_RESOLVE_ARGS)
+//	-redact-args           log arguments holding references as [redacted] (env AWS_INIT_REDACT_ARGS)
 //
 // # Secret Reference Formats
 //
@@ -23,14 +47,84 @@
 //
 //	aws-secret:secret-name
 //
-// Secrets Manager (JSON key extraction):
+// Secrets Manager (JSON key extraction, nested paths, JSON Pointer):
 //
 //	aws-secret:secret-name#key
+//	aws-secret:secret-name#db.host
+//	aws-secret:secret-name#/db/host
+//
+// Secrets Manager (pinned staging label or version ID):
+//
+//	aws-secret:secret-name:AWSPREVIOUS#key
+//
+// ECS valueFrom ARNs (json-key, version-stage and version-id fields):
+//
+//	aws-secret:arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db-AbCdEf:password:AWSPREVIOUS:
+//	aws-secret:arn:aws:ssm:us-east-1:123456789012:parameter/myapp/prod/feature_flag
 //
 // Parameter Store (via Secrets Manager reference):
 //
 //	aws-secret:/aws/reference/secretsmanager/secret-name
 //
+// Parameter Store (any parameter by name or ARN, with optional :version or :label):
+//
+//	aws-ssm:/myapp/prod/feature_flag
+//	aws-ssm:/myapp/prod/config:3#key
+//
+// References embedded in a larger value:
+//
+//	postgres://app:${aws-secret:myapp/db#password}@db:5432/app
+//
+// CloudFormation dynamic references, whole or embedded:
+//
+//	{{resolve:secretsmanager:myapp/prod:SecretString:password:AWSCURRENT}}
+//	{{resolve:ssm-secure:/myapp/db}}
+//
+// Secret written to a file, with the variable set to the file's path:
+//
+//	aws-secret-file:myapp/tls#key|mode=0400|owner=1000:1000
+//	aws-ssm-file:/myapp/prod/kubeconfig|path=kubeconfig
+//
+// Binary secrets, and string secrets holding encoded binary data (see
+// binary.go):
+//
+//	aws-secret:myapp/keystore|encoding=base64
+//	aws-secret-file:myapp/tls#key_base64|decode=base64
+//
+// Optional references, and defaults for secrets, parameters or keys that do
+// not exist:
+//
+//	aws-secret:secret-name#key|optional
+//	aws-ssm:/myapp/prod/log_level|default=info
+//
+// References in the child's arguments, with -resolve-args (see args.go):
+//
+//	aws-init -resolve-args redis-server --requirepass aws-secret:myapp/redis#password
+//
+// Reference names built from other, plain variables (see vars.go):
+//
+//	aws-secret:myapp/${STAGE}#database_url
+//
+// Query options and backslash escapes (see reference.go):
+//
+//	aws-secret:secret-name#key?version=AWSPREVIOUS&region=eu-west-1&optional
+//	aws-secret:secret-name#enabled\?
+//
+// Bulk expansion of every top-level key of a JSON secret:
+//
+//	AWS_INIT_EXPAND_MYAPP=aws-secret:myapp/prod|prefix=MYAPP_|case=upper
+//
+// Every parameter under a Parameter Store path:
+//
+//	AWS_INIT_EXPAND_CONFIG=aws-ssm:/myapp/prod/|case=upper
+//
+// # Config Templates
+//
+// Go text/template files can be rendered before the child starts, using the
+// secret, parameter, jsonKey, yaml, json and shell functions:
+//
+//	aws-init -template /etc/app/config.yaml.tmpl python app.py
+//
 // # Authentication
 //
 // Uses standard AWS credential chain including:
@@ -85,8 +179,18 @@
 //
 // # Security
 //
-// Secrets are resolved once at startup and passed to the child process via
-// environment variables. No secrets are logged or persisted to disk.
+// Secrets are resolved at startup, and again whenever they change in watch
+// mode, and passed to the child process via environment variables, or via
+// files on a tmpfs for aws-secret-file: and aws-ssm-file: references.
+// Secret files are removed when the child exits.
+// With -resolve-args, secrets may also be passed as arguments, where other
+// processes can read them from /proc/<pid>/cmdline.
+//
+// Secret values are never logged. They reach persistent storage only where
+// configured to: config templates are rendered to their destination paths
+// with mode 0600, and -cache-dir keeps an AES-256-GCM encrypted copy of
+// every fetched value (see cache.go). Secret files written outside the
+// tmpfs with path= are on whatever storage holds that path.
 // Use minimal IAM permissions for production deployments.
 package main
 
@@ -113,6 +217,8 @@ const (
 func main() {
 	versionFlag := flag.Bool("v", false, "show version")
 	healthFlag := flag.Bool("h", false, "health check")
+	opts := defaultOptions()
+	opts.registerFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *versionFlag {
@@ -127,21 +233,65 @@ func main() {
 
 	args := flag.Args()
 	if len(args) == 0 {
-		log.Fatal("usage: aws-init command [args...]")
+		log.Fatal("usage: aws-init [flags] command [args...]")
 	}
 
 	if os.Getpid() == 1 {
 		log.Println("aws-init: running as PID 1")
 	}
 
+	// Arguments, environment and templates share one resolver and its
+	// fetches
+	shared := newSharedResolver(opts)
+
+	// Bound all of startup resolution by one deadline, so that an
+	// unreachable endpoint fails startup instead of hanging it
+	ctx, cancel := opts.resolveContext(context.Background())
+
+	// Resolve references in arguments, once, before any mode starts. Logs
+	// show them as written, never resolved.
+	label := args[0]
+	if opts.resolveArgs {
+		label = describeCommand(args[0], args[1:], opts.redactArgs)
+
+		resolved, err := resolveArgs(ctx, args[1:], os.Environ(), shared)
+		if err != nil {
+			removeSecretFiles()
+			log.Fatalf("aws-init: %v", err)
+		}
+		args = append([]string{args[0]}, resolved...)
+	}
+
+	// Restart the child when referenced secrets change
+	if opts.watchInterval > 0 {
+		code, err := executeWatched(ctx, args[0], args[1:], os.Environ(), label, shared)
+		cancel()
+		if err != nil {
+			removeSecretFiles()
+			log.Fatalf("aws-init: %v", err)
+		}
+		removeSecretFiles()
+		os.Exit(code)
+	}
+
 	// Resolve AWS secrets in environment
-	env, err := resolveSecrets(context.Background(), os.Environ())
+	env, err := resolveSecrets(ctx, os.Environ(), shared)
 	if err != nil {
+		removeSecretFiles()
+		log.Fatalf("aws-init: %v", err)
+	}
+
+	// Render config templates with resolved secrets
+	if err := renderTemplates(ctx, opts.templates.values, env, shared); err != nil {
+		removeSecretFiles()
 		log.Fatalf("aws-init: %v", err)
 	}
+	cancel()
 
 	// Execute command with signal handling
-	os.Exit(execute(args[0], args[1:], env))
+	code := execute(args[0], args[1:], env, label)
+	removeSecretFiles()
+	os.Exit(code)
 }
 
 // healthCheck verifies AWS credentials and connectivity.
@@ -31,6 +31,11 @@ func TestResolveSecrets(t *testing.T) {
 			name: "malformed env var",
 			env:  []string{"MALFORMED", "GOOD=value"},
 		},
+		{
+			name:    "empty parameter reference",
+			env:     []string{"BAD=aws-ssm:"},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -38,7 +43,7 @@ func TestResolveSecrets(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 			defer cancel()
 
-			_, err := resolveSecrets(ctx, tt.env)
+			_, err := resolveSecrets(ctx, tt.env, newSharedResolver(defaultOptions()))
 			if (err != nil) != tt.wantErr {
 				t.Errorf("resolveSecrets() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -0,0 +1,257 @@
+// Package main provides runtime configuration for aws-init.
+//
+// This file contains the options shared by secret resolution and process
+// execution. Every option can be set with a command line flag, and each flag
+// takes its default from an AWS_INIT_* environment variable so containers can
+// be configured without changing their entrypoint.
+//
+// # Configuration
+//
+//	-parallel            AWS_INIT_PARALLEL            maximum concurrent AWS API calls (default 8)
+//	-secrets-dir         AWS_INIT_SECRETS_DIR         base directory for secret files (default /dev/shm)
+//	-template            AWS_INIT_TEMPLATES           SRC[:DST] template to render; repeatable, or comma-separated in the env
+//	-retry-max-attempts  AWS_INIT_RETRY_MAX_ATTEMPTS  attempts per AWS API call, including the first (default 3)
+//	-retry-base-delay    AWS_INIT_RETRY_BASE_DELAY    backoff before the first retry, doubled per retry (default 100ms)
+//	-retry-max-delay     AWS_INIT_RETRY_MAX_DELAY     maximum backoff between retries, 0 for no cap (default 5s)
+//	-call-timeout        AWS_INIT_CALL_TIMEOUT        timeout for each AWS API call attempt (default 10s)
+//	-resolve-timeout     AWS_INIT_RESOLVE_TIMEOUT     deadline for resolving secrets and rendering templates (default 60s)
+//	-watch-interval      AWS_INIT_WATCH_INTERVAL      poll for changed secrets and restart the child (default 0, off)
+//	-watch-jitter        AWS_INIT_WATCH_JITTER        maximum random delay added to each poll (default 30s)
+//	-watch-signal        AWS_INIT_WATCH_SIGNAL        rewrite files and send this signal (e.g. HUP) on change instead of restarting
+//	-cache-dir           AWS_INIT_CACHE_DIR           directory of the encrypted secret cache, see cache.go (default none, off)
+//	-cache-key-file      AWS_INIT_CACHE_KEY_FILE      file holding the 32-byte cache key
+//	-cache-kms-key       AWS_INIT_CACHE_KMS_KEY       KMS key that protects the cache data key
+//	-cache-ttl           AWS_INIT_CACHE_TTL           serve cached values younger than this without fetching (default 0)
+//	-cache-max-stale     AWS_INIT_CACHE_MAX_STALE     serve cached values this long past the TTL when AWS fails (default 24h)
+//	-fallback-region     AWS_INIT_FALLBACK_REGIONS    region to try after a transient failure, see region.go; repeatable, or comma-separated in the env
+//	-role-session-name   AWS_INIT_ROLE_SESSION_NAME   session name of roles assumed by references, see role.go (default aws-init)
+//	-resolve-args        AWS_INIT_RESOLVE_ARGS        resolve references in the child's arguments, see args.go (default false)
+//	-redact-args         AWS_INIT_REDACT_ARGS         log arguments holding references as [redacted] (default false)
+//
+// A zero duration disables the corresponding timeout.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultParallel       = 8
+	defaultResolveTimeout = 60 * time.Second
+	defaultWatchJitter    = 30 * time.Second
+)
+
+// options holds the settings that control secret resolution.
+type options struct {
+	// parallel caps the number of AWS API calls in flight at once.
+	parallel int
+	// secretsDir is where file references are written; empty selects
+	// /dev/shm, or the system temp directory if /dev/shm does not exist.
+	secretsDir string
+	// templates lists SRC[:DST] config templates rendered before the child starts.
+	templates stringList
+	// retry controls retries of transient AWS API errors and the timeout of
+	// each attempt.
+	retry retryPolicy
+	// resolveTimeout bounds resolution and template rendering as a whole.
+	resolveTimeout time.Duration
+	// watchInterval enables watch mode, see watch.go; zero disables it.
+	watchInterval time.Duration
+	// watchJitter is the maximum random delay added to each watch poll.
+	watchJitter time.Duration
+	// watchSignal, if set, is sent to the child after a refresh instead of
+	// restarting it.
+	watchSignal string
+	// cache configures the encrypted on-disk cache, see cache.go.
+	cache cacheOptions
+	// fallbackRegions are tried in order when a fetch fails with a
+	// transient error, see region.go.
+	fallbackRegions stringList
+	// roleSessionName is the default session name of assumed roles, see
+	// role.go.
+	roleSessionName string
+	// resolveArgs enables references in the child's arguments, see args.go.
+	resolveArgs bool
+	// redactArgs hides arguments holding references in the "started" log
+	// line.
+	redactArgs bool
+}
+
+// cacheOptions holds the settings of the encrypted on-disk cache.
+type cacheOptions struct {
+	// dir enables the cache; empty disables it.
+	dir string
+	// keyFile and kmsKey select the encryption key; exactly one is required.
+	keyFile string
+	kmsKey  string
+	// ttl is how long entries are served without fetching.
+	ttl time.Duration
+	// maxStale is how long past ttl entries may replace failed fetches.
+	maxStale time.Duration
+}
+
+// defaultOptions returns the options used when no flags or AWS_INIT_*
+// environment variables are set.
+func defaultOptions() options {
+	return options{
+		parallel: defaultParallel,
+		retry: retryPolicy{
+			maxAttempts: defaultMaxAttempts,
+			baseDelay:   defaultBaseDelay,
+			maxDelay:    defaultMaxDelay,
+			callTimeout: defaultCallTimeout,
+		},
+		resolveTimeout: defaultResolveTimeout,
+		watchJitter:    defaultWatchJitter,
+		cache: cacheOptions{
+			maxStale: defaultMaxStale,
+		},
+	}
+}
+
+// registerFlags binds opts to command line flags on fs.
+//
+// Flag defaults are read from the corresponding AWS_INIT_* environment
+// variables, so an explicit flag always wins over the environment.
+func (o *options) registerFlags(fs *flag.FlagSet) {
+	fs.IntVar(&o.parallel, "parallel", envInt("AWS_INIT_PARALLEL", o.parallel), "maximum concurrent AWS API calls")
+	fs.StringVar(&o.secretsDir, "secrets-dir", envString("AWS_INIT_SECRETS_DIR", o.secretsDir), "base directory for secret files")
+
+	o.templates = envList("AWS_INIT_TEMPLATES", o.templates)
+	fs.Var(&o.templates, "template", "render SRC[:DST] config template before starting (repeatable)")
+
+	fs.IntVar(&o.retry.maxAttempts, "retry-max-attempts", envInt("AWS_INIT_RETRY_MAX_ATTEMPTS", o.retry.maxAttempts), "attempts per AWS API call, including the first")
+	fs.DurationVar(&o.retry.baseDelay, "retry-base-delay", envDuration("AWS_INIT_RETRY_BASE_DELAY", o.retry.baseDelay), "backoff before the first retry, doubled per retry")
+	fs.DurationVar(&o.retry.maxDelay, "retry-max-delay", envDuration("AWS_INIT_RETRY_MAX_DELAY", o.retry.maxDelay), "maximum backoff between retries (0 for no cap)")
+	fs.DurationVar(&o.retry.callTimeout, "call-timeout", envDuration("AWS_INIT_CALL_TIMEOUT", o.retry.callTimeout), "timeout for each AWS API call attempt (0 disables)")
+	fs.DurationVar(&o.resolveTimeout, "resolve-timeout", envDuration("AWS_INIT_RESOLVE_TIMEOUT", o.resolveTimeout), "deadline for resolving secrets and rendering templates (0 disables)")
+
+	fs.DurationVar(&o.watchInterval, "watch-interval", envDuration("AWS_INIT_WATCH_INTERVAL", o.watchInterval), "poll for changed secrets and restart the child (0 disables)")
+	fs.DurationVar(&o.watchJitter, "watch-jitter", envDuration("AWS_INIT_WATCH_JITTER", o.watchJitter), "maximum random delay added to each watch poll")
+	fs.StringVar(&o.watchSignal, "watch-signal", envString("AWS_INIT_WATCH_SIGNAL", o.watchSignal), "rewrite files and send this signal on change instead of restarting")
+
+	fs.StringVar(&o.cache.dir, "cache-dir", envString("AWS_INIT_CACHE_DIR", o.cache.dir), "directory of the encrypted secret cache (empty disables)")
+	fs.StringVar(&o.cache.keyFile, "cache-key-file", envString("AWS_INIT_CACHE_KEY_FILE", o.cache.keyFile), "file holding the 32-byte cache key")
+	fs.StringVar(&o.cache.kmsKey, "cache-kms-key", envString("AWS_INIT_CACHE_KMS_KEY", o.cache.kmsKey), "KMS key that protects the cache data key")
+	fs.DurationVar(&o.cache.ttl, "cache-ttl", envDuration("AWS_INIT_CACHE_TTL", o.cache.ttl), "serve cached values younger than this without fetching")
+	fs.DurationVar(&o.cache.maxStale, "cache-max-stale", envDuration("AWS_INIT_CACHE_MAX_STALE", o.cache.maxStale), "serve cached values up to this long past the TTL when AWS is unavailable (0 disables)")
+
+	o.fallbackRegions = envList("AWS_INIT_FALLBACK_REGIONS", o.fallbackRegions)
+	fs.Var(&o.fallbackRegions, "fallback-region", "region to try when AWS fails with a transient error (repeatable, in order)")
+	fs.StringVar(&o.roleSessionName, "role-session-name", envString("AWS_INIT_ROLE_SESSION_NAME", o.roleSessionName), "session name for roles assumed by references (default aws-init)")
+
+	fs.BoolVar(&o.resolveArgs, "resolve-args", envBool("AWS_INIT_RESOLVE_ARGS", o.resolveArgs), "resolve references in the child's arguments (visible in /proc/<pid>/cmdline)")
+	fs.BoolVar(&o.redactArgs, "redact-args", envBool("AWS_INIT_REDACT_ARGS", o.redactArgs), "log arguments holding references as [redacted]")
+}
+
+// resolveContext returns a child of parent bounded by the resolution
+// timeout.
+func (o options) resolveContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if o.resolveTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, o.resolveTimeout)
+}
+
+// stringList is a repeatable flag. The first explicit use replaces the
+// default taken from the environment; later uses append.
+type stringList struct {
+	values []string
+	set    bool
+}
+
+func (l *stringList) String() string {
+	return strings.Join(l.values, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	if !l.set {
+		l.values = nil
+		l.set = true
+	}
+	l.values = append(l.values, value)
+	return nil
+}
+
+// envList returns the comma-separated values of the named environment
+// variable, or def if it is unset or empty.
+func envList(name string, def stringList) stringList {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	var list stringList
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list.values = append(list.values, v)
+		}
+	}
+	return list
+}
+
+// envString returns the value of the named environment variable, or def if
+// it is unset or empty.
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envDuration returns the duration value of the named environment variable,
+// such as "250ms" or "2s", or def if it is unset or not a valid duration.
+func envDuration(name string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("aws-init: ignoring invalid %s=%q: %v", name, value, err)
+		return def
+	}
+
+	return d
+}
+
+// envInt returns the integer value of the named environment variable, or def
+// if it is unset or not a valid integer.
+func envInt(name string, def int) int {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("aws-init: ignoring invalid %s=%q: %v", name, value, err)
+		return def
+	}
+
+	return n
+}
+
+// envBool returns the boolean value of the named environment variable, such
+// as "true" or "1", or def if it is unset or not a valid boolean.
+func envBool(name string, def bool) bool {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("aws-init: ignoring invalid %s=%q: %v", name, value, err)
+		return def
+	}
+
+	return b
+}
@@ -0,0 +1,246 @@
+// Package main provides the secret reference grammar and its parser.
+//
+// This file contains the scanner that splits a reference into its prefix,
+// target, key and options. parseSecretRef (see secrets.go) is the single
+// entry point built on it, used by environment values, interpolation,
+// expand directives and templates alike.
+//
+// # Grammar
+//
+//	reference = prefix target [ "#" key ] [ "?" query ] { "|" option }
+//	prefix    = "aws-secret:" | "aws-ssm:" | "aws-secret-file:" | "aws-ssm-file:"
+//	query     = option { "&" option }
+//	option    = name [ "=" value ]
+//
+// The target is a secret name, ARN or parameter name, with the selectors
+// described in secrets.go and arn.go. The first '#' starts the key; later
+// ones belong to it. Query options and "|" options are interchangeable:
+//
+//	aws-secret:myapp/db#password?version=AWSPREVIOUS&region=eu-west-1&optional
+//	aws-secret:myapp/db#password|version=AWSPREVIOUS|region=eu-west-1|optional
+//
+// Inside "|" options only '|' is special, so default values may contain
+// '?', '&' and '='.
+//
+// # Escaping
+//
+// A backslash makes the next character literal, so keys and option values
+// can contain the characters of the grammar:
+//
+//	aws-secret:myapp/flags#enabled\?
+//	aws-ssm:/myapp/motd|default=a\|b
+//	DSN=${aws-secret:myapp/db#password|default=\}}
+//
+// # Errors
+//
+// Parse errors name the 1-based column of the reference, or of the whole
+// value for interpolated references, where the problem was found.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// referenceSyntax is a scanned reference, with escapes removed, whose
+// target and options have not been interpreted yet.
+type referenceSyntax struct {
+	prefix  string
+	target  string // name with any selector or ECS fields
+	key     string
+	hasKey  bool
+	options []referenceOption
+}
+
+// referenceOption is one query or "|" option.
+type referenceOption struct {
+	name     string
+	value    string
+	hasValue bool
+	column   int // where the option starts
+}
+
+// referenceError is a parse error at a column of the reference.
+type referenceError struct {
+	column int
+	err    error
+}
+
+func (e *referenceError) Error() string {
+	return fmt.Sprintf("column %d: %v", e.column, e.err)
+}
+
+func (e *referenceError) Unwrap() error {
+	return e.err
+}
+
+// atColumn wraps err as a referenceError at column unless it already is one.
+func atColumn(column int, err error) error {
+	var refErr *referenceError
+	if errors.As(err, &refErr) {
+		return err
+	}
+	return &referenceError{column: column, err: err}
+}
+
+// shiftColumn moves the column of a referenceError by offset, for references
+// embedded at offset in a larger value.
+func shiftColumn(err error, offset int) error {
+	var refErr *referenceError
+	if errors.As(err, &refErr) {
+		return &referenceError{column: refErr.column + offset, err: refErr.err}
+	}
+	return err
+}
+
+// referencePrefixes are the known prefixes, longest first so that file
+// prefixes win over the plain ones they extend.
+var referencePrefixes = []string{secretFilePrefix, parameterFilePrefix, secretPrefix, parameterPrefix}
+
+// scanReference splits ref into its parts. A reference without a known
+// prefix is scanned as an aws-secret: reference.
+//
+// Returns a referenceError for a trailing backslash or an empty option.
+func scanReference(ref string) (referenceSyntax, error) {
+	var syntax referenceSyntax
+	for _, prefix := range referencePrefixes {
+		if strings.HasPrefix(ref, prefix) {
+			syntax.prefix = prefix
+			break
+		}
+	}
+
+	const (
+		inTarget = iota
+		inKey
+		inQuery
+		inPipe
+	)
+	section := inTarget
+
+	var text strings.Builder // target, key, or current option name or value
+	var option *referenceOption
+	finishOption := func() error {
+		if option == nil {
+			return nil
+		}
+		if option.hasValue {
+			option.value = text.String()
+		} else {
+			option.name = text.String()
+		}
+		if option.name == "" {
+			return &referenceError{column: option.column, err: fmt.Errorf("empty option")}
+		}
+		syntax.options = append(syntax.options, *option)
+		option = nil
+		return nil
+	}
+	startOption := func(column, next int) error {
+		switch section {
+		case inTarget:
+			syntax.target = text.String()
+		case inKey:
+			syntax.key = text.String()
+		default:
+			if err := finishOption(); err != nil {
+				return err
+			}
+		}
+		text.Reset()
+		section = next
+		option = &referenceOption{column: column + 1}
+		return nil
+	}
+
+	for i := len(syntax.prefix); i < len(ref); i++ {
+		c := ref[i]
+		column := i + 1
+
+		if c == '\\' {
+			if i+1 == len(ref) {
+				return referenceSyntax{}, &referenceError{column: column, err: fmt.Errorf("trailing backslash")}
+			}
+			i++
+			text.WriteByte(ref[i])
+			continue
+		}
+
+		switch {
+		case c == '#' && section == inTarget:
+			syntax.target = text.String()
+			syntax.hasKey = true
+			text.Reset()
+			section = inKey
+		case c == '?' && (section == inTarget || section == inKey):
+			if err := startOption(column, inQuery); err != nil {
+				return referenceSyntax{}, err
+			}
+		case c == '&' && section == inQuery:
+			if err := startOption(column, inQuery); err != nil {
+				return referenceSyntax{}, err
+			}
+		case c == '|':
+			if err := startOption(column, inPipe); err != nil {
+				return referenceSyntax{}, err
+			}
+		case c == '=' && (section == inQuery || section == inPipe) && !option.hasValue:
+			option.name = text.String()
+			option.hasValue = true
+			text.Reset()
+		default:
+			text.WriteByte(c)
+		}
+	}
+
+	switch section {
+	case inTarget:
+		syntax.target = text.String()
+	case inKey:
+		syntax.key = text.String()
+	default:
+		if err := finishOption(); err != nil {
+			return referenceSyntax{}, err
+		}
+	}
+
+	return syntax, nil
+}
+
+// referenceEnd returns the index of the '}' that ends an interpolated
+// reference in s, skipping escaped braces and nested ${VAR}, or -1.
+func referenceEnd(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case strings.HasPrefix(s[i:], "${"):
+			depth++
+			i++
+		case s[i] == '}' && depth > 0:
+			depth--
+		case s[i] == '}':
+			return i
+		}
+	}
+	return -1
+}
+
+// escapeReference escapes the characters of the grammar in s, so that it
+// scans back to s as a key.
+func escapeReference(s string) string {
+	if !strings.ContainsAny(s, `\?|&}`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(`\?|&}`, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
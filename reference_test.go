@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestScanReference(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want referenceSyntax
+	}{
+		{
+			ref:  "aws-secret:myapp/db",
+			want: referenceSyntax{prefix: secretPrefix, target: "myapp/db"},
+		},
+		{
+			ref:  "aws-secret:myapp/db#a#b",
+			want: referenceSyntax{prefix: secretPrefix, target: "myapp/db", key: "a#b", hasKey: true},
+		},
+		{
+			ref: "aws-ssm:/myapp/flag?version=3&optional",
+			want: referenceSyntax{prefix: parameterPrefix, target: "/myapp/flag", options: []referenceOption{
+				{name: "version", value: "3", hasValue: true, column: 21},
+				{name: "optional", column: 31},
+			}},
+		},
+		{
+			ref: "aws-secret-file:myapp/tls#key?region=eu-west-1|default=a?b&c=d",
+			want: referenceSyntax{prefix: secretFilePrefix, target: "myapp/tls", key: "key", hasKey: true, options: []referenceOption{
+				{name: "region", value: "eu-west-1", hasValue: true, column: 31},
+				{name: "default", value: "a?b&c=d", hasValue: true, column: 48},
+			}},
+		},
+		{
+			ref: `aws-secret:myapp/config#channels\#general\?\|x|default=a\|b\\`,
+			want: referenceSyntax{prefix: secretPrefix, target: "myapp/config", key: "channels#general?|x", hasKey: true, options: []referenceOption{
+				{name: "default", value: `a|b\`, hasValue: true, column: 48},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := scanReference(tt.ref)
+			if err != nil {
+				t.Fatalf("scanReference() error = %v", err)
+			}
+			if got.prefix != tt.want.prefix || got.target != tt.want.target || got.key != tt.want.key || got.hasKey != tt.want.hasKey {
+				t.Errorf("scanReference() = %+v, want %+v", got, tt.want)
+			}
+			if len(got.options) != len(tt.want.options) {
+				t.Fatalf("options = %+v, want %+v", got.options, tt.want.options)
+			}
+			for i := range got.options {
+				if got.options[i] != tt.want.options[i] {
+					t.Errorf("option %d = %+v, want %+v", i, got.options[i], tt.want.options[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseSecretRefQueryOptions(t *testing.T) {
+	const id = "01234567-89ab-cdef-0123-456789abcdef"
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    secretRef
+		wantErr bool
+	}{
+		{
+			name: "query",
+			ref:  "aws-secret:myapp/db#password?version=AWSPREVIOUS&region=eu-west-1&optional",
+			want: secretRef{name: "myapp/db", key: "password", hasKey: true, versionStage: "AWSPREVIOUS", region: "eu-west-1", optional: true},
+		},
+		{
+			name: "pipe options are equivalent",
+			ref:  "aws-secret:myapp/db#password|version=AWSPREVIOUS|region=eu-west-1|optional",
+			want: secretRef{name: "myapp/db", key: "password", hasKey: true, versionStage: "AWSPREVIOUS", region: "eu-west-1", optional: true},
+		},
+		{
+			name: "version id",
+			ref:  "aws-secret:myapp/db?version=" + id,
+			want: secretRef{name: "myapp/db", versionID: id},
+		},
+		{
+			name: "version id that is not a UUID",
+			ref:  "aws-secret:myapp/db|version-id=0123456789abcdef0123456789abcdef",
+			want: secretRef{name: "myapp/db", versionID: "0123456789abcdef0123456789abcdef"},
+		},
+		{
+			name: "staging label that looks like a UUID",
+			ref:  "aws-secret:myapp/db?version-stage=" + id,
+			want: secretRef{name: "myapp/db", versionStage: id},
+		},
+		{
+			name: "non-UUID selector is a staging label",
+			ref:  "aws-secret:myapp/db?version=0123456789abcdef0123456789abcdef",
+			want: secretRef{name: "myapp/db", versionStage: "0123456789abcdef0123456789abcdef"},
+		},
+		{
+			name: "parameter version",
+			ref:  "aws-ssm:/myapp/flag?version=3",
+			want: secretRef{name: "/myapp/flag:3", parameter: true},
+		},
+		{
+			name: "escaped default",
+			ref:  `aws-ssm:/myapp/motd?default=a\&b`,
+			want: secretRef{name: "/myapp/motd", parameter: true, hasDefault: true, defaultValue: "a&b"},
+		},
+		{name: "version twice", ref: "aws-secret:myapp/db:AWSPREVIOUS?version=AWSCURRENT", wantErr: true},
+		{name: "parameter version twice", ref: "aws-ssm:/myapp/flag:2?version=3", wantErr: true},
+		{name: "empty version", ref: "aws-secret:myapp/db?version=", wantErr: true},
+		{name: "version id twice", ref: "aws-secret:myapp/db:AWSPREVIOUS?version-id=" + id, wantErr: true},
+		{name: "empty version id", ref: "aws-secret:myapp/db?version-id=", wantErr: true},
+		{name: "parameter version id", ref: "aws-ssm:/myapp/flag?version-id=3", wantErr: true},
+		{name: "unknown option", ref: "aws-secret:myapp/db?verison=1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSecretRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSecretRef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSecretRef() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSecretRefErrorColumns(t *testing.T) {
+	tests := []struct {
+		ref    string
+		column int
+	}{
+		{ref: "aws-secret:", column: 12},
+		{ref: "aws-secret:myapp/db?verison=1", column: 21},
+		{ref: "aws-secret:myapp/db?optional&&region=eu-west-1", column: 30},
+		{ref: "aws-secret:myapp/db|region=eu_west", column: 21},
+		{ref: `aws-secret:myapp/db#key\`, column: 24},
+		{ref: "aws-ssm:/myapp/flag|mode=0400", column: 21},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			_, err := parseSecretRef(tt.ref)
+			var refErr *referenceError
+			if !errors.As(err, &refErr) {
+				t.Fatalf("parseSecretRef() error = %v, want a referenceError", err)
+			}
+			if refErr.column != tt.column {
+				t.Errorf("column = %d, want %d (%v)", refErr.column, tt.column, err)
+			}
+		})
+	}
+}
+
+func TestParseInterpolationEscapes(t *testing.T) {
+	parts, err := parseInterpolation(`x=${aws-ssm:/myapp/motd|default=\}}!`, nil)
+	if err != nil {
+		t.Fatalf("parseInterpolation() error = %v", err)
+	}
+	if len(parts) != 3 || parts[1].ref.defaultValue != "}" || parts[2].literal != "!" {
+		t.Errorf("parseInterpolation() = %+v", parts)
+	}
+
+	// Columns count from the start of the value
+	_, err = parseInterpolation("postgres://${aws-secret:myapp/db?bogus}", nil)
+	var refErr *referenceError
+	if !errors.As(err, &refErr) || refErr.column != 34 {
+		t.Errorf("parseInterpolation() error = %v, want column 34", err)
+	}
+}
+
+func TestEscapeReference(t *testing.T) {
+	for _, key := range []string{"plain", "a?b", `a|b\c`, "}"} {
+		ref := "aws-secret:myapp/db#" + escapeReference(key)
+		parsed, err := parseSecretRef(ref)
+		if err != nil {
+			t.Fatalf("parseSecretRef(%q) error = %v", ref, err)
+		}
+		if parsed.key != key {
+			t.Errorf("key of %q = %q, want %q", ref, parsed.key, key)
+		}
+	}
+}
+
+func TestParseExpandDirectiveReferenceOptions(t *testing.T) {
+	d, err := parseExpandDirective("aws-secret:myapp/prod?region=eu-west-1&version=AWSPREVIOUS|prefix=MYAPP_|optional", nil)
+	if err != nil {
+		t.Fatalf("parseExpandDirective() error = %v", err)
+	}
+	if d.ref.region != "eu-west-1" || d.ref.versionStage != "AWSPREVIOUS" {
+		t.Errorf("ref = %+v, want region and version applied", d.ref)
+	}
+	if d.prefix != "MYAPP_" || !d.optional {
+		t.Errorf("directive = %+v, want prefix and optional", d)
+	}
+}
@@ -0,0 +1,150 @@
+// Package main provides per-reference regions and cross-region failover.
+//
+// This file contains the functions that pick the AWS region a reference is
+// read from and retry transient failures against replicas in other regions.
+//
+// # Regions
+//
+// A reference is read from the region of the default AWS configuration
+// unless it names another one, either with the region option or as part of
+// a full ARN:
+//
+//	DB_PASSWORD=aws-secret:myapp/db#password|region=eu-west-1
+//	API_KEY=aws-secret:arn:aws:secretsmanager:us-west-2:123456789012:secret:myapp/api-AbCdEf
+//	FLAG=aws-ssm:arn:aws:ssm:us-west-2:123456789012:parameter/myapp/flag
+//
+// A region option that contradicts the region of an ARN is an error.
+// Clients for other regions are created on first use and share the
+// credentials of the default configuration, or of the reference's role.
+//
+// # Failover
+//
+// With -fallback-region or AWS_INIT_FALLBACK_REGIONS, a fetch that still
+// fails with a transient error after its retries is repeated in each
+// fallback region in order, until one succeeds:
+//
+//	aws-init -fallback-region us-west-2 -fallback-region eu-west-1 python app.py
+//
+// Secrets Manager replicas keep the name of their primary, and the region
+// in an ARN is replaced with the fallback region. Errors such as not found
+// or access denied are never failed over, and if every region fails the
+// primary region's error is reported.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// awsClients is the pair of AWS clients for one region and identity.
+type awsClients struct {
+	secrets secretsManagerAPI
+	ssm     ssmAPI
+}
+
+// clientKey selects a pair of clients: a region, empty for the default one,
+// and a role to assume, empty for the default credentials (see role.go).
+type clientKey struct {
+	region string
+	role   roleSpec
+}
+
+// clients returns the clients for key, creating them on first use. The
+// default region and credentials select the default clients, as does a
+// resolver without newClients.
+func (r *resolver) clients(key clientKey) awsClients {
+	if key.region == "" {
+		key.region = r.region
+	}
+	if (key.region == r.region && key.role == roleSpec{}) || r.newClients == nil {
+		return awsClients{secrets: r.secrets, ssm: r.ssm}
+	}
+
+	r.clientsMu.Lock()
+	defer r.clientsMu.Unlock()
+
+	if r.extraClients == nil {
+		r.extraClients = make(map[clientKey]awsClients)
+	}
+	c, ok := r.extraClients[key]
+	if !ok {
+		c = r.newClients(key)
+		r.extraClients[key] = c
+	}
+	return c
+}
+
+// failover repeats the fetch of t, which failed in its own region with err,
+// in each fallback region in turn.
+//
+// Returns the first value fetched. If err is not transient, or every
+// fallback region fails, err itself is returned.
+func (r *resolver) failover(ctx context.Context, t fetchTarget, err error) fetchResult {
+	primary := t.region
+	if primary == "" {
+		primary = r.region
+	}
+
+	for _, region := range r.fallbackRegions {
+		if region == primary {
+			continue
+		}
+		if !isTransient(err) || ctx.Err() != nil {
+			break
+		}
+
+		log.Printf("aws-init: %s failed in %s, trying %s: %s", t.name, primary, region, errorDetail(err))
+
+		replica := t
+		replica.region = region
+		replica.name = regionalName(t.name, region)
+
+		res := r.fetch(ctx, replica)
+		if res.err == nil {
+			return res
+		}
+		if !isTransient(res.err) {
+			log.Printf("aws-init: %s failed in %s: %s", t.name, region, errorDetail(res.err))
+		}
+	}
+
+	return fetchResult{err: err}
+}
+
+// arnRegion returns the region field of an ARN, or "" if name is not an ARN.
+func arnRegion(name string) string {
+	if !strings.HasPrefix(name, "arn:") {
+		return ""
+	}
+
+	// arn:partition:service:region:account:resource
+	fields := strings.SplitN(name, ":", 6)
+	if len(fields) < 6 {
+		return ""
+	}
+	return fields[3]
+}
+
+// regionalName returns name as it is known in region: ARNs have their
+// region replaced, plain names are unchanged.
+func regionalName(name, region string) string {
+	if arnRegion(name) == "" {
+		return name
+	}
+
+	fields := strings.SplitN(name, ":", 6)
+	fields[3] = region
+	return strings.Join(fields, ":")
+}
+
+// validateRegion reports an error if region is not shaped like an AWS region
+// code such as us-east-1.
+func validateRegion(region string) error {
+	if region == "" || strings.Trim(region, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" ||
+		!strings.Contains(region, "-") {
+		return fmt.Errorf("invalid region %q", region)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestArnRegion(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantRegion string
+		wantName   string // regionalName(name, "eu-west-1")
+	}{
+		{
+			name:       "arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db-AbCdEf",
+			wantRegion: "us-east-1",
+			wantName:   "arn:aws:secretsmanager:eu-west-1:123456789012:secret:myapp/db-AbCdEf",
+		},
+		{
+			name:       "arn:aws:ssm:us-west-2:123456789012:parameter/myapp/flag",
+			wantRegion: "us-west-2",
+			wantName:   "arn:aws:ssm:eu-west-1:123456789012:parameter/myapp/flag",
+		},
+		{name: "myapp/db", wantName: "myapp/db"},
+		{name: "/myapp/flag", wantName: "/myapp/flag"},
+		{name: "arn:short", wantName: "arn:short"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := arnRegion(tt.name); got != tt.wantRegion {
+				t.Errorf("arnRegion() = %q, want %q", got, tt.wantRegion)
+			}
+			if got := regionalName(tt.name, "eu-west-1"); got != tt.wantName {
+				t.Errorf("regionalName() = %q, want %q", got, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestParseSecretRefRegion(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", ref: "aws-secret:myapp/db"},
+		{name: "option", ref: "aws-secret:myapp/db#password|region=eu-west-1", want: "eu-west-1"},
+		{name: "parameter option", ref: "aws-ssm:/myapp/flag|region=us-west-2", want: "us-west-2"},
+		{name: "from arn", ref: "aws-secret:arn:aws:secretsmanager:us-west-2:123456789012:secret:myapp/db-AbCdEf", want: "us-west-2"},
+		{name: "matching option", ref: "aws-ssm:arn:aws:ssm:us-west-2:123456789012:parameter/x|region=us-west-2", want: "us-west-2"},
+		{name: "conflicting option", ref: "aws-ssm:arn:aws:ssm:us-west-2:123456789012:parameter/x|region=eu-west-1", wantErr: true},
+		{name: "invalid region", ref: "aws-secret:myapp/db|region=EU_WEST", wantErr: true},
+		{name: "empty region", ref: "aws-secret:myapp/db|region=", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSecretRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSecretRef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.region != tt.want {
+				t.Errorf("region = %q, want %q", got.region, tt.want)
+			}
+		})
+	}
+}
+
+// newRegionalResolver returns a resolver whose default region is us-east-1,
+// with one fake Secrets Manager per region.
+func newRegionalResolver(fakes map[string]*fakeSecretsManager, fallback ...string) *resolver {
+	return &resolver{
+		secrets:         fakes["us-east-1"],
+		ssm:             newFakeSSM(nil),
+		parallel:        4,
+		region:          "us-east-1",
+		fallbackRegions: fallback,
+		newClients: func(key clientKey) awsClients {
+			return awsClients{secrets: fakes[key.region], ssm: newFakeSSM(nil)}
+		},
+	}
+}
+
+func TestResolverRegions(t *testing.T) {
+	east := newFakeSecretsManager(map[string]string{"myapp/db": "east"})
+	west := newFakeSecretsManager(map[string]string{
+		"myapp/db": "west",
+		"arn:aws:secretsmanager:us-west-2:123456789012:secret:myapp/api": "key",
+	})
+	r := newRegionalResolver(map[string]*fakeSecretsManager{"us-east-1": east, "us-west-2": west})
+
+	result, err := r.resolve(context.Background(), []string{
+		"LOCAL=aws-secret:myapp/db",
+		"REMOTE=aws-secret:myapp/db|region=us-west-2",
+		"API=aws-secret:arn:aws:secretsmanager:us-west-2:123456789012:secret:myapp/api",
+	})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	got := envSliceToMap(result)
+	want := map[string]string{"LOCAL": "east", "REMOTE": "west", "API": "key"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if west.batchCalls != 1 {
+		t.Errorf("us-west-2 batch calls = %d, want 1", west.batchCalls)
+	}
+}
+
+func TestResolverFailover(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	denied := &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized"}
+
+	tests := []struct {
+		name      string
+		ref       string
+		eastErr   error
+		westErr   error
+		want      string
+		wantErr   string
+		wantWest  bool
+		fallbacks []string
+	}{
+		{
+			name:      "transient error fails over",
+			ref:       "aws-secret:myapp/db",
+			eastErr:   throttled,
+			want:      "west",
+			wantWest:  true,
+			fallbacks: []string{"us-west-2"},
+		},
+		{
+			name:      "arn is rewritten for the replica",
+			ref:       "aws-secret:arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db",
+			eastErr:   throttled,
+			want:      "west-arn",
+			wantWest:  true,
+			fallbacks: []string{"us-west-2"},
+		},
+		{
+			name:      "access denied does not fail over",
+			ref:       "aws-secret:myapp/db",
+			eastErr:   denied,
+			wantErr:   "access denied",
+			fallbacks: []string{"us-west-2"},
+		},
+		{
+			name:      "every region fails",
+			ref:       "aws-secret:myapp/db",
+			eastErr:   throttled,
+			westErr:   throttled,
+			wantErr:   "throttled",
+			wantWest:  true,
+			fallbacks: []string{"us-west-2"},
+		},
+		{
+			name:    "no fallback regions",
+			ref:     "aws-secret:myapp/db",
+			eastErr: throttled,
+			wantErr: "throttled",
+		},
+		{
+			name:      "own region is skipped",
+			ref:       "aws-secret:myapp/db|region=us-west-2",
+			westErr:   throttled,
+			want:      "east",
+			wantWest:  true,
+			fallbacks: []string{"us-west-2", "us-east-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			east := newFakeSecretsManager(map[string]string{"myapp/db": "east"})
+			west := newFakeSecretsManager(map[string]string{
+				"myapp/db": "west",
+				"arn:aws:secretsmanager:us-west-2:123456789012:secret:myapp/db": "west-arn",
+			})
+			if tt.eastErr != nil {
+				east.errs = map[string]error{
+					"myapp/db": tt.eastErr,
+					"arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/db": tt.eastErr,
+				}
+			}
+			if tt.westErr != nil {
+				west.errs = map[string]error{"myapp/db": tt.westErr}
+			}
+			r := newRegionalResolver(map[string]*fakeSecretsManager{"us-east-1": east, "us-west-2": west}, tt.fallbacks...)
+
+			result, err := r.resolve(context.Background(), []string{"DB=" + tt.ref})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("resolve() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			} else if got := envSliceToMap(result)["DB"]; got != tt.want {
+				t.Errorf("DB = %q, want %q", got, tt.want)
+			}
+
+			calledWest := len(west.calls) > 0
+			if calledWest != tt.wantWest {
+				t.Errorf("called us-west-2 = %v, want %v", calledWest, tt.wantWest)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// Package main provides the retry policy for AWS API calls.
+//
+// This file contains the policy that decides whether a failed call is worth
+// repeating and how long to wait first. Only transient failures are retried:
+// throttling, timeouts, 5xx responses and connection errors. Errors such as
+// ResourceNotFoundException or AccessDeniedException fail on the first
+// attempt, since repeating the call cannot change the outcome.
+//
+// # Backoff
+//
+// The delay before retry n is drawn uniformly from [0, min(maxDelay,
+// baseDelay*2^(n-1))] ("full jitter"), so that many containers starting at
+// once do not retry in lockstep. A maxDelay of zero leaves the ceiling
+// uncapped.
+//
+// The SDK's own retryer is disabled in newResolver so that this policy is
+// the only one applied.
+//
+// # Timeouts
+//
+// Each attempt runs with its own callTimeout. An attempt that times out is
+// transient and retried, while the caller's context bounds the whole
+// sequence of attempts.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+)
+
+const (
+	defaultMaxAttempts = 3
+	defaultBaseDelay   = 100 * time.Millisecond
+	defaultMaxDelay    = 5 * time.Second
+	defaultCallTimeout = 10 * time.Second
+)
+
+// retryPolicy controls how many times a transient failure is retried and
+// how long to wait between attempts.
+type retryPolicy struct {
+	// maxAttempts is the total number of attempts, including the first.
+	// Values below 1 mean a single attempt.
+	maxAttempts int
+	// baseDelay is the backoff ceiling before the first retry; it doubles
+	// with every further retry.
+	baseDelay time.Duration
+	// maxDelay caps the backoff ceiling; zero means no cap.
+	maxDelay time.Duration
+	// callTimeout bounds each attempt; zero means no per-attempt limit.
+	callTimeout time.Duration
+}
+
+// do calls fn until it succeeds, fails with a permanent error, the context is
+// cancelled, or maxAttempts attempts have been made. fn receives a context
+// limited to callTimeout and should use it for its API call.
+//
+// Returns nil on success. A permanent error is returned as is; a transient
+// error that outlasts every attempt is wrapped with the attempt count, and
+// one cut short by the end of ctx is wrapped with ctx.Err().
+func (p retryPolicy) do(ctx context.Context, fn func(context.Context) error) error {
+	attempts := max(p.maxAttempts, 1)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = p.attempt(ctx, fn); err == nil {
+			return nil
+		}
+		if !isTransient(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return interrupted(ctx, err)
+		}
+		if attempt == attempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return interrupted(ctx, err)
+		case <-time.After(p.backoff(attempt)):
+		}
+	}
+
+	return fmt.Errorf("failed after %d attempts: %w", attempts, err)
+}
+
+// interrupted returns the last transient error err of a call whose context
+// ended, wrapped with the context's error so that callers can tell it from
+// an error that outlasted every attempt.
+func interrupted(ctx context.Context, err error) error {
+	if errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w (last error: %w)", ctx.Err(), err)
+}
+
+// attempt calls fn once, with callTimeout applied to ctx.
+func (p retryPolicy) attempt(ctx context.Context, fn func(context.Context) error) error {
+	if p.callTimeout <= 0 {
+		return fn(ctx)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, p.callTimeout)
+	defer cancel()
+	return fn(callCtx)
+}
+
+// backoff returns a jittered delay to wait after the given failed attempt.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.baseDelay
+	for i := 1; i < attempt; i++ {
+		if (p.maxDelay > 0 && ceiling >= p.maxDelay) || ceiling > math.MaxInt64/2 {
+			break
+		}
+		ceiling *= 2
+	}
+	if p.maxDelay > 0 && ceiling > p.maxDelay {
+		ceiling = p.maxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return rand.N(ceiling + 1)
+}
+
+// isTransient reports whether err is a failure that may succeed if the call
+// is repeated.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	switch classify(err) {
+	case causeThrottled, causeTimeout:
+		return true
+	}
+
+	return awsretry.IsErrorRetryables(awsretry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
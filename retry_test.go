@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	denied := &smithy.GenericAPIError{Code: "AccessDeniedException"}
+
+	tests := []struct {
+		name      string
+		errs      []error // returned by successive calls; nil after the list ends
+		wantCalls int
+		wantErr   string
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "transient then success", errs: []error{throttled, throttled}, wantCalls: 3},
+		{name: "transient exhausted", errs: []error{throttled, throttled, throttled, throttled}, wantCalls: 3, wantErr: "failed after 3 attempts"},
+		{name: "permanent", errs: []error{denied}, wantCalls: 1, wantErr: "AccessDeniedException"},
+		{name: "not found", errs: []error{&smithy.GenericAPIError{Code: "ResourceNotFoundException"}}, wantCalls: 1, wantErr: "ResourceNotFoundException"},
+		{name: "transient then permanent", errs: []error{throttled, denied}, wantCalls: 2, wantErr: "AccessDeniedException"},
+	}
+
+	p := retryPolicy{maxAttempts: 3, baseDelay: time.Millisecond, maxDelay: 2 * time.Millisecond}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := p.do(context.Background(), func(context.Context) error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("do() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("do() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := retryPolicy{maxAttempts: 5, baseDelay: time.Hour, maxDelay: time.Hour}
+
+	calls := 0
+	err := p.do(ctx, func(context.Context) error {
+		calls++
+		cancel()
+		return &smithy.GenericAPIError{Code: "ThrottlingException"}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("do() = %v after %d calls, want error after 1 call", err, calls)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("do() error = %v, want it to wrap context.Canceled", err)
+	}
+}
+
+func TestRetryPolicyDeadlineDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	p := retryPolicy{maxAttempts: 5, baseDelay: time.Hour, maxDelay: time.Hour}
+
+	err := p.do(ctx, func(context.Context) error {
+		return &smithy.GenericAPIError{Code: "ThrottlingException"}
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("do() error = %v, want it to wrap context.DeadlineExceeded", err)
+	}
+	if !strings.Contains(err.Error(), "ThrottlingException") {
+		t.Errorf("do() error = %v, want the last error kept", err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := retryPolicy{baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+
+	for attempt, ceiling := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		50: time.Second,
+	} {
+		for range 100 {
+			if d := p.backoff(attempt); d < 0 || d > ceiling {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", attempt, d, ceiling)
+			}
+		}
+	}
+}
+
+func TestRetryBackoffUncapped(t *testing.T) {
+	p := retryPolicy{baseDelay: 100 * time.Millisecond}
+
+	// Without a cap the ceiling keeps doubling: 1.6s before the fifth retry
+	var longest time.Duration
+	for range 200 {
+		d := p.backoff(5)
+		if d < 0 || d > 1600*time.Millisecond {
+			t.Fatalf("backoff(5) = %v, want within [0, 1.6s]", d)
+		}
+		longest = max(longest, d)
+	}
+	if longest <= p.baseDelay {
+		t.Errorf("backoff(5) never exceeded %v, want the ceiling to double", p.baseDelay)
+	}
+
+	if d := p.backoff(100); d < 0 {
+		t.Errorf("backoff(100) = %v, want a non-negative delay", d)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&smithy.GenericAPIError{Code: "ThrottlingException"}, true},
+		{&smithy.GenericAPIError{Code: "TooManyRequestsException"}, true},
+		{&smithy.GenericAPIError{Code: "RequestTimeout"}, true},
+		{fmt.Errorf("call: %w", context.DeadlineExceeded), true},
+		{&smithy.GenericAPIError{Code: "ResourceNotFoundException"}, false},
+		{&smithy.GenericAPIError{Code: "AccessDeniedException"}, false},
+		{&keyNotFoundError{key: "k", name: "n"}, false},
+		{context.Canceled, false},
+		{errors.New("binary secrets not supported"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyCallTimeout(t *testing.T) {
+	p := retryPolicy{maxAttempts: 3, baseDelay: time.Millisecond, callTimeout: 10 * time.Millisecond}
+
+	calls := 0
+	err := p.do(context.Background(), func(ctx context.Context) error {
+		if calls++; calls == 1 {
+			<-ctx.Done() // a call that never answers
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("do() = %v after %d calls, want success after 2 calls", err, calls)
+	}
+}
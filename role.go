@@ -0,0 +1,110 @@
+// Package main provides per-reference role assumption for cross-account
+// secrets.
+//
+// This file contains the functions that let a reference be read with the
+// credentials of an IAM role assumed through STS, for example a role in a
+// central security account that owns shared platform secrets.
+//
+// # Syntax
+//
+//	DB_PASSWORD=aws-secret:platform/db#password|role=arn:aws:iam::111122223333:role/secrets-reader
+//	API_KEY=aws-ssm:/platform/api_key|role=arn:aws:iam::111122223333:role/reader|external-id=acme|session-name=billing
+//
+// Options:
+//   - role=ARN: the role to assume before fetching
+//   - external-id=ID: the external ID the role's trust policy requires
+//   - session-name=NAME: the role session name recorded in CloudTrail;
+//     defaults to -role-session-name or AWS_INIT_ROLE_SESSION_NAME, or
+//     "aws-init"
+//
+// # Sessions
+//
+// References with the same role, external ID and session name share one
+// session: AssumeRole is called once, on first use, and again only when the
+// temporary credentials are about to expire. The AssumeRole call itself is
+// made with the default credentials.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+)
+
+const defaultRoleSessionName = "aws-init"
+
+// roleSpec identifies a role session. The zero value means the default
+// credentials.
+type roleSpec struct {
+	arn         string
+	externalID  string
+	sessionName string
+}
+
+// roleSessions hands out one cached credentials provider per role session.
+type roleSessions struct {
+	client      stscreds.AssumeRoleAPIClient
+	sessionName string // default session name
+
+	mu       sync.Mutex
+	sessions map[roleSpec]aws.CredentialsProvider
+}
+
+// newRoleSessions returns sessions that assume roles with client, using
+// sessionName where a reference does not name its session.
+func newRoleSessions(client stscreds.AssumeRoleAPIClient, sessionName string) *roleSessions {
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+	return &roleSessions{client: client, sessionName: sessionName, sessions: make(map[roleSpec]aws.CredentialsProvider)}
+}
+
+// credentials returns the credentials provider for role, creating it on
+// first use. Providers cache their credentials until shortly before expiry.
+func (s *roleSessions) credentials(role roleSpec) aws.CredentialsProvider {
+	if role.sessionName == "" {
+		role.sessionName = s.sessionName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if provider, ok := s.sessions[role]; ok {
+		return provider
+	}
+
+	provider := aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(s.client, role.arn, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = role.sessionName
+		if role.externalID != "" {
+			o.ExternalID = aws.String(role.externalID)
+		}
+	}))
+	s.sessions[role] = provider
+	return provider
+}
+
+// validateRoleARN reports an error if arn is not an IAM role ARN.
+func validateRoleARN(arn string) error {
+	fields := strings.SplitN(arn, ":", 6)
+	if len(fields) < 6 || fields[0] != "arn" || fields[2] != "iam" || !strings.HasPrefix(fields[5], "role/") {
+		return fmt.Errorf("invalid role ARN %q", arn)
+	}
+	return nil
+}
+
+// validateSessionName reports an error if name is not a valid role session
+// name: 2 to 64 characters from letters, digits and +=,.@_-.
+func validateSessionName(name string) error {
+	if len(name) < 2 || len(name) > 64 {
+		return fmt.Errorf("invalid session name %q: must be 2 to 64 characters", name)
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("+=,.@_-", c) && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') {
+			return fmt.Errorf("invalid session name %q: unexpected %q", name, c)
+		}
+	}
+	return nil
+}
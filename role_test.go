@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// fakeSTS records AssumeRole calls and returns credentials valid for an hour.
+type fakeSTS struct {
+	mu    sync.Mutex
+	calls []*sts.AssumeRoleInput
+}
+
+func (f *fakeSTS) AssumeRole(ctx context.Context, in *sts.AssumeRoleInput, _ ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, in)
+	f.mu.Unlock()
+
+	return &sts.AssumeRoleOutput{Credentials: &ststypes.Credentials{
+		AccessKeyId:     aws.String("AKIAEXAMPLE"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(time.Now().Add(time.Hour)),
+	}}, nil
+}
+
+func TestParseSecretRefRole(t *testing.T) {
+	const role = "arn:aws:iam::111122223333:role/secrets-reader"
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    roleSpec
+		wantErr bool
+	}{
+		{name: "no role", ref: "aws-secret:platform/db"},
+		{name: "role", ref: "aws-secret:platform/db|role=" + role, want: roleSpec{arn: role}},
+		{
+			name: "external id and session name",
+			ref:  "aws-ssm:/platform/key|role=" + role + "|external-id=acme|session-name=billing@prod",
+			want: roleSpec{arn: role, externalID: "acme", sessionName: "billing@prod"},
+		},
+		{name: "not a role", ref: "aws-secret:platform/db|role=arn:aws:iam::111122223333:user/bob", wantErr: true},
+		{name: "not an arn", ref: "aws-secret:platform/db|role=secrets-reader", wantErr: true},
+		{name: "external id without role", ref: "aws-secret:platform/db|external-id=acme", wantErr: true},
+		{name: "empty external id", ref: "aws-secret:platform/db|role=" + role + "|external-id=", wantErr: true},
+		{name: "invalid session name", ref: "aws-secret:platform/db|role=" + role + "|session-name=has space", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSecretRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSecretRef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.role != tt.want {
+				t.Errorf("role = %+v, want %+v", got.role, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoleSessionsShareAssumeRole(t *testing.T) {
+	const role = "arn:aws:iam::111122223333:role/secrets-reader"
+
+	client := &fakeSTS{}
+	sessions := newRoleSessions(client, "")
+
+	for _, spec := range []roleSpec{
+		{arn: role},
+		{arn: role},
+		{arn: role, externalID: "acme", sessionName: "billing"},
+	} {
+		if _, err := sessions.credentials(spec).Retrieve(context.Background()); err != nil {
+			t.Fatalf("Retrieve() error = %v", err)
+		}
+	}
+
+	if len(client.calls) != 2 {
+		t.Fatalf("AssumeRole calls = %d, want 2", len(client.calls))
+	}
+	if got := aws.ToString(client.calls[0].RoleSessionName); got != defaultRoleSessionName {
+		t.Errorf("default session name = %q, want %q", got, defaultRoleSessionName)
+	}
+	if client.calls[0].ExternalId != nil {
+		t.Errorf("ExternalId = %q, want unset", aws.ToString(client.calls[0].ExternalId))
+	}
+	if got := aws.ToString(client.calls[1].RoleSessionName); got != "billing" {
+		t.Errorf("session name = %q, want billing", got)
+	}
+	if got := aws.ToString(client.calls[1].ExternalId); got != "acme" {
+		t.Errorf("ExternalId = %q, want acme", got)
+	}
+}
+
+func TestResolverRoleClients(t *testing.T) {
+	const role = "arn:aws:iam::111122223333:role/secrets-reader"
+
+	local := newFakeSecretsManager(map[string]string{"platform/db": "local"})
+	shared := newFakeSecretsManager(map[string]string{"platform/db": "shared", "platform/api": "key"})
+
+	var created []clientKey
+	r := &resolver{
+		secrets:  local,
+		ssm:      newFakeSSM(nil),
+		parallel: 4,
+		region:   "us-east-1",
+		newClients: func(key clientKey) awsClients {
+			created = append(created, key)
+			return awsClients{secrets: shared, ssm: newFakeSSM(nil)}
+		},
+	}
+
+	result, err := r.resolve(context.Background(), []string{
+		"LOCAL=aws-secret:platform/db",
+		"SHARED=aws-secret:platform/db|role=" + role,
+		"API=aws-secret:platform/api|role=" + role,
+	})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	got := envSliceToMap(result)
+	want := map[string]string{"LOCAL": "local", "SHARED": "shared", "API": "key"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if len(created) != 1 || created[0].role.arn != role || created[0].region != "us-east-1" {
+		t.Errorf("clients created for %+v, want one for the role in us-east-1", created)
+	}
+	if shared.batchCalls != 1 {
+		t.Errorf("batch calls with the role = %d, want 1", shared.batchCalls)
+	}
+}
@@ -2,6 +2,7 @@
 //
 // This file contains functions for resolving AWS Secrets Manager and
 // Systems Manager Parameter Store references in environment variables.
+// Variables whose value starts with "aws-secret:" or "aws-ssm:" are resolved.
 //
 // # Secret Reference Format
 //
@@ -9,48 +10,233 @@
 //
 //	aws-secret:secret-name
 //
-// Secrets Manager (JSON key extraction):
+// Secrets Manager (JSON key extraction, see jsonpath.go for nested paths):
 //
 //	aws-secret:secret-name#key
+//	aws-secret:secret-name#db.port
+//
+// Secrets Manager (pinned staging label or version ID):
+//
+//	aws-secret:secret-name:AWSPREVIOUS#key
+//	aws-secret:secret-name:01234567-89ab-cdef-0123-456789abcdef
 //
 // Parameter Store (via Secrets Manager reference):
 //
 //	aws-secret:/aws/reference/secretsmanager/secret-name
 //
+// Parameter Store (any parameter by name or ARN, SecureStrings decrypted):
+//
+//	aws-ssm:/myapp/prod/feature_flag
+//	aws-ssm:/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64
+//	aws-ssm:arn:aws:ssm:us-east-1:123456789012:parameter/myapp/prod/db#host
+//
+// Inline interpolation of references inside a larger value (see interpolate.go):
+//
+//	DATABASE_URL=postgres://app:${aws-secret:myapp/db#password}@db:5432/app
+//
+// CloudFormation dynamic references (see dynamicref.go):
+//
+//	DB_PASSWORD={{resolve:secretsmanager:myapp/db:SecretString:password:AWSCURRENT}}
+//	API_KEY={{resolve:ssm-secure:/myapp/api_key}}
+//
+// File delivery, setting the variable to the path of a file holding the value
+// (see files.go):
+//
+//	TLS_KEY=aws-secret-file:myapp/tls#key|mode=0400
+//
+// Bulk expansion of a JSON secret into one variable per key (see expand.go):
+//
+//	AWS_INIT_EXPAND_MYAPP=aws-secret:myapp/prod|prefix=MYAPP_|case=upper
+//
+// Optional references and defaults, used only when the secret, parameter or
+// key does not exist:
+//
+//	SENTRY_DSN=aws-secret:myapp/prod#sentry_dsn|optional
+//	LOG_LEVEL=aws-ssm:/myapp/prod/log_level|default=info
+//
+// Another region, with cross-region failover (see region.go):
+//
+//	DB_PASSWORD=aws-secret:myapp/db#password|region=eu-west-1
+//
+// Another account, through an assumed role (see role.go):
+//
+//	SHARED_KEY=aws-secret:platform/key|role=arn:aws:iam::111122223333:role/secrets-reader
+//
+// # Versions
+//
+// Without a selector the AWSCURRENT version is read. A selector that looks
+// like a UUID is sent as the VersionId; anything else is sent as the
+// VersionStage, so AWSPREVIOUS, AWSPENDING and custom staging labels all work.
+// Secret ARNs take the ECS valueFrom fields instead, see arn.go.
+//
+// Version IDs are client request tokens and need not be UUIDs. Those that
+// are not are pinned with the version-id= option, and version-stage= names
+// a staging label whatever its form:
+//
+//	aws-secret:myapp/db|version-id=0123456789abcdef0123456789abcdef
+//
+// Parameter Store names accept the native selector syntax, name:3 for a
+// version or name:label for a label, which is passed through to SSM.
+//
+// # Concurrency
+//
+// All references are collected before any AWS call is made. Each distinct
+// secret or parameter is fetched exactly once, no matter how many variables
+// reference it, and fetches run concurrently up to the configured parallelism.
+//
+// Secrets Manager references are grouped into BatchGetSecretValue calls of
+// up to 20 secrets and Parameter Store references into GetParameters calls of
+// up to 10 parameters. Secrets pinned to a version are fetched individually
+// because BatchGetSecretValue only returns AWSCURRENT. If the batch API is
+// unavailable, for example because the IAM policy only grants
+// GetSecretValue, each target is fetched individually instead.
+//
 // # Error Handling
 //
-// Functions implement retry logic with exponential backoff for transient
-// AWS API errors. Context cancellation is respected for timeout handling.
+// Transient AWS API errors are retried with exponential backoff and jitter,
+// see retry.go. Context cancellation is respected for timeout handling.
 package main
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"maps"
+	"slices"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
 const (
-	secretPrefix = "aws-secret:"
-	maxRetries   = 3
-	retryDelay   = 100 * time.Millisecond
+	secretPrefix       = "aws-secret:"
+	parameterPrefix    = "aws-ssm:"
+	ssmReferencePrefix = "/aws/reference/secretsmanager/"
 )
 
+// secretsManagerAPI is the subset of the Secrets Manager client used by aws-init.
+type secretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	BatchGetSecretValue(ctx context.Context, params *secretsmanager.BatchGetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.BatchGetSecretValueOutput, error)
+	DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error)
+}
+
+// ssmAPI is the subset of the Systems Manager client used by aws-init.
+type ssmAPI interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+	GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error)
+	GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
+}
+
+// secretRef is a parsed aws-secret: reference.
+type secretRef struct {
+	name         string // secret name, ARN or parameter path
+	key          string // JSON key to extract, if hasKey is set
+	hasKey       bool
+	parameter    bool     // fetched from Parameter Store instead of Secrets Manager
+	path         bool     // every parameter under name, see getParametersByPath
+	versionID    string   // pinned Secrets Manager version ID
+	versionStage string   // pinned Secrets Manager staging label
+	file         fileSpec // write the value to a file, see files.go
+	optional     bool     // leave the variable unset if not found
+	hasDefault   bool     // use defaultValue if not found
+	defaultValue string
+	ignoreErrors bool     // fall back on any error, not only "not found"
+	region       string   // region to read from, see region.go; empty for the default
+	role         roleSpec // role to assume before reading, see role.go
+	encoding     string   // encode the value as base64 or hex, see binary.go
+	decode       string   // decode a base64 or hex string secret, see binary.go
+}
+
+// fetchTarget identifies a single value in AWS. References that share a
+// target share one API call.
+type fetchTarget struct {
+	parameter    bool
+	path         bool
+	name         string
+	versionID    string
+	versionStage string
+	region       string
+	role         roleSpec
+}
+
+// clientKey returns the key of the clients the target is fetched with.
+func (t fetchTarget) clientKey() clientKey {
+	return clientKey{region: t.region, role: t.role}
+}
+
+// pinned reports whether the reference names a specific secret version.
+func (ref secretRef) pinned() bool {
+	return ref.versionID != "" || ref.versionStage != ""
+}
+
+// pinned reports whether the target names a specific secret version.
+func (t fetchTarget) pinned() bool {
+	return t.versionID != "" || t.versionStage != ""
+}
+
+// fetchResult holds the outcome of fetching one target.
+type fetchResult struct {
+	value  string
+	binary bool // value holds the raw bytes of a binary secret
+	err    error
+}
+
+// resolver resolves secret references using a pair of AWS clients for the
+// default region, and further pairs for other regions on demand.
+type resolver struct {
+	secrets    secretsManagerAPI
+	ssm        ssmAPI
+	parallel   int
+	secretsDir string
+	retry      retryPolicy
+
+	// region is the region of secrets and ssm.
+	region string
+	// fallbackRegions are tried in order after a transient failure, see
+	// region.go.
+	fallbackRegions []string
+	// newClients, if non-nil, creates the clients for another region or
+	// role.
+	newClients   func(key clientKey) awsClients
+	clientsMu    sync.Mutex
+	extraClients map[clientKey]awsClients
+
+	// tracked, if non-nil, records every target fetched, for watch mode.
+	tracked map[fetchTarget]bool
+	// staged, if non-nil, collects secret files instead of writing them
+	// immediately, see fileStage.
+	staged *fileStage
+	// cache, if non-nil, serves fresh entries and outage fallbacks, see
+	// cache.go.
+	cache *secretCache
+	// skipFresh fetches every target even if the cache holds a fresh entry,
+	// while still allowing stale fallbacks, for watch mode refreshes.
+	skipFresh bool
+	// pass, if non-nil, keeps every result of the current resolution pass,
+	// such as startup or one watch refresh, so that later lookups in the
+	// same pass do not fetch again.
+	pass map[fetchTarget]fetchResult
+}
+
 // resolveSecrets processes environment variables and resolves AWS secret references.
 //
-// Environment variables with "aws-secret:" prefixes are resolved by fetching
-// the corresponding values from AWS Secrets Manager or Parameter Store.
+// Environment variables with "aws-secret:" or "aws-ssm:" prefixes are resolved
+// by fetching the corresponding values from AWS Secrets Manager or Parameter Store.
 // Variables without the prefix are passed through unchanged.
 //
 // Parameters:
 //   - ctx: context for request cancellation and timeouts
 //   - env: slice of environment variables in "KEY=value" format
+//   - shared: the resolver shared with templates, created on first use
 //
 // Returns a new slice of environment variables with secrets resolved, or an error
 // if any secret resolution fails.
@@ -62,19 +248,22 @@ const (
 //	  "API_KEY=aws-secret:myapp/prod#api_key",
 //	  "NORMAL_VAR=regular_value",
 //	}
-//	resolved, err := resolveSecrets(ctx, env)
+//	resolved, err := resolveSecrets(ctx, env, newSharedResolver(defaultOptions()))
 //	// resolved contains actual secret values instead of references
+//	// myapp/prod is fetched once and shared by both variables
 //
 // Common errors returned by resolveSecrets:
 //   - AWS credential errors: check IAM permissions and credential configuration
 //   - Network errors: verify connectivity to AWS services
 //   - Secret not found: ensure secret exists and name is correct
 //   - JSON parsing errors: verify secret format for key extraction
-func resolveSecrets(ctx context.Context, env []string) ([]string, error) {
+func resolveSecrets(ctx context.Context, env []string, shared *sharedResolver) ([]string, error) {
 	// Quick scan - do we have any secrets to resolve?
 	hasSecrets := false
 	for _, e := range env {
-		if strings.Contains(e, secretPrefix) {
+		if strings.Contains(e, secretPrefix) || strings.Contains(e, parameterPrefix) ||
+			strings.Contains(e, secretFilePrefix) || strings.Contains(e, parameterFilePrefix) ||
+			strings.HasPrefix(e, expandPrefix) || containsDynamicRef(e) {
 			hasSecrets = true
 			break
 		}
@@ -84,26 +273,157 @@ func resolveSecrets(ctx context.Context, env []string) ([]string, error) {
 		return env, nil
 	}
 
-	// Initialize AWS clients
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRetryMaxAttempts(maxRetries))
+	r, err := shared.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.resolve(ctx, env)
+}
+
+// sharedResolver creates a resolver on first use and hands out the same one
+// afterwards, so that arguments, the environment and templates share AWS
+// clients, role sessions and the cache, and fetch each target once. Nothing is loaded if
+// nothing needs resolving.
+type sharedResolver struct {
+	opts options
+	r    *resolver
+	err  error
+}
+
+// newSharedResolver returns a shared resolver for opts.
+func newSharedResolver(opts options) *sharedResolver {
+	return &sharedResolver{opts: opts}
+}
+
+// get returns the resolver, creating it with newResolver on the first call.
+// Its results are kept for the rest of startup, see resolver.pass.
+func (s *sharedResolver) get(ctx context.Context) (*resolver, error) {
+	if s.r == nil && s.err == nil {
+		s.r, s.err = newResolver(ctx, s.opts)
+		if s.r != nil {
+			s.r.pass = make(map[fetchTarget]fetchResult)
+		}
+	}
+	return s.r, s.err
+}
+
+// newResolver loads the default AWS configuration and returns a resolver
+// using Secrets Manager and Systems Manager clients built from it.
+func newResolver(ctx context.Context, opts options) (*resolver, error) {
+	// Retries are handled by opts.retry rather than the SDK's retryer.
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRetryer(func() aws.Retryer {
+		return aws.NopRetryer{}
+	}))
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
-	secretsClient := secretsmanager.NewFromConfig(cfg)
-	ssmClient := ssm.NewFromConfig(cfg)
+	for _, region := range opts.fallbackRegions.values {
+		if err := validateRegion(region); err != nil {
+			return nil, fmt.Errorf("invalid fallback region: %w", err)
+		}
+	}
+
+	if opts.roleSessionName != "" {
+		if err := validateSessionName(opts.roleSessionName); err != nil {
+			return nil, fmt.Errorf("invalid role session name: %w", err)
+		}
+	}
+	sessions := newRoleSessions(sts.NewFromConfig(cfg), opts.roleSessionName)
+
+	// Starting without the cache is better than not starting at all
+	cache, err := newSecretCache(ctx, kms.NewFromConfig(cfg), opts)
+	if err != nil {
+		log.Printf("aws-init: warning: cache disabled: %v", err)
+	}
+
+	return &resolver{
+		secrets:         secretsmanager.NewFromConfig(cfg),
+		ssm:             ssm.NewFromConfig(cfg),
+		parallel:        opts.parallel,
+		secretsDir:      opts.secretsDir,
+		retry:           opts.retry,
+		region:          cfg.Region,
+		fallbackRegions: opts.fallbackRegions.values,
+		newClients: func(key clientKey) awsClients {
+			c := cfg.Copy()
+			c.Region = key.region
+			if key.role.arn != "" {
+				c.Credentials = sessions.credentials(key.role)
+			}
+			return awsClients{secrets: secretsmanager.NewFromConfig(c), ssm: ssm.NewFromConfig(c)}
+		},
+		cache: cache,
+	}, nil
+}
+
+// resolve parses every reference in env, fetches each distinct target once,
+// and substitutes the results back into the environment.
+//
+// Every reference is attempted before returning. If any fail, the error is a
+// report of all failures in env order, so the outcome does not depend on
+// which concurrent fetch finishes first.
+func (r *resolver) resolve(ctx context.Context, env []string) ([]string, error) {
+	report := newErrorReport(env)
+	vars := newPlainVars(env)
+	values := make(map[int][]valuePart)
+	directives := make(map[int]expandDirective)
+	var targets []fetchTarget
+	seen := make(map[fetchTarget]bool)
+	addTarget := func(t fetchTarget) {
+		if !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+
+	for i, e := range env {
+		name, value, found := strings.Cut(e, "=")
+		if !found {
+			continue
+		}
+
+		if isExpandDirective(name) {
+			d, err := parseExpandDirective(value, vars)
+			if err != nil {
+				report.add(name, "", err)
+				continue
+			}
+			directives[i] = d
+			addTarget(d.ref.target())
+			continue
+		}
+
+		parts, ok := parseValue(name, value, vars, report)
+		if !ok {
+			continue
+		}
+		for _, part := range parts {
+			if part.isRef {
+				addTarget(part.ref.target())
+			}
+		}
+		values[i] = parts
+	}
+
+	fetched := r.fetchBounded(ctx, targets)
 
 	var result []string
-	for _, e := range env {
+	for i, e := range env {
 		name, value, found := strings.Cut(e, "=")
 		if !found {
 			continue // malformed env var
 		}
 
-		if strings.HasPrefix(value, secretPrefix) {
-			resolved, err := resolveSecret(ctx, secretsClient, ssmClient, value)
-			if err != nil {
-				return nil, fmt.Errorf("failed to resolve %s: %w", name, err)
+		if _, ok := directives[i]; ok {
+			continue // expanded below
+		}
+
+		if parts, ok := values[i]; ok {
+			resolved, set := r.render(name, parts, fetched, report)
+			if !set {
+				continue
 			}
 			value = resolved
 		}
@@ -111,134 +431,779 @@ func resolveSecrets(ctx context.Context, env []string) ([]string, error) {
 		result = append(result, name+"="+value)
 	}
 
+	result = expandAll(result, env, directives, fetched, report)
+	if err := report.err(); err != nil {
+		return nil, err
+	}
+
 	return result, nil
 }
 
+// parseValue parses the value of variable name into literal text and
+// references. Parse errors are added to report.
+//
+// Returns false if the value holds no references or fails to parse.
+func parseValue(name, value string, vars *plainVars, report *errorReport) ([]valuePart, bool) {
+	var parts []valuePart
+	switch {
+	case isReference(value):
+		expanded, err := vars.expand(value)
+		if err != nil {
+			report.add(name, "", err)
+			return nil, false
+		}
+		ref, err := parseSecretRef(expanded)
+		if err != nil {
+			report.add(name, "", err)
+			return nil, false
+		}
+		parts = []valuePart{{ref: ref, isRef: true}}
+	case isInterpolated(value):
+		var err error
+		if parts, err = parseInterpolation(value, vars); err != nil {
+			report.add(name, "", err)
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	valid := true
+	for _, part := range parts {
+		if part.isRef && part.ref.path {
+			report.add(name, part.ref.describe(), fmt.Errorf("parameter paths can only be loaded with %s", expandPrefix))
+			valid = false
+		}
+	}
+	return parts, valid
+}
+
+// fetchBounded fetches targets like fetchAll, naming the references that
+// were cut off by the resolution deadline of ctx.
+func (r *resolver) fetchBounded(ctx context.Context, targets []fetchTarget) map[fetchTarget]fetchResult {
+	fetched := r.fetchAll(ctx, targets)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		for t, res := range fetched {
+			if errors.Is(res.err, ctxErr) {
+				fetched[t] = fetchResult{err: &deadlineError{err: ctxErr}}
+			}
+		}
+	}
+	return fetched
+}
+
+// render builds the value of the variable name from its parts, writing file
+// references to disk and substituting their paths.
+//
+// The second result is false if the variable should be left unset, either
+// because its only part is an optional reference that was not found or
+// because a reference failed. Failures are added to report.
+func (r *resolver) render(name string, parts []valuePart, fetched map[fetchTarget]fetchResult, report *errorReport) (string, bool) {
+	var b strings.Builder
+	files := 0
+	failed := false
+
+	for _, part := range parts {
+		if !part.isRef {
+			b.WriteString(part.literal)
+			continue
+		}
+
+		resolved, err := part.ref.lookup(fetched)
+		if err != nil {
+			if !part.ref.tolerates(err) {
+				report.add(name, part.ref.describe(), err)
+				failed = true
+				continue
+			}
+			if !part.ref.hasDefault {
+				log.Printf("aws-init: %s: optional %s not resolved: %v", name, part.ref.name, err)
+				if len(parts) == 1 {
+					return "", false
+				}
+				continue
+			}
+			log.Printf("aws-init: %s: using default for %s: %v", name, part.ref.name, err)
+			resolved = part.ref.defaultValue
+		}
+
+		if part.ref.file.enabled {
+			// Several file references in one value need distinct default names.
+			fileName := name
+			if files++; files > 1 {
+				fileName = fmt.Sprintf("%s_%d", name, files)
+			}
+			if resolved, err = r.writeFile(fileName, part.ref.file, []byte(resolved)); err != nil {
+				report.add(name, part.ref.describe(), err)
+				failed = true
+				continue
+			}
+		}
+
+		b.WriteString(resolved)
+	}
+
+	if failed {
+		return "", false
+	}
+	return b.String(), true
+}
+
+// lookup returns the reference's value from a set of fetch results.
+func (ref secretRef) lookup(fetched map[fetchTarget]fetchResult) (string, error) {
+	return ref.value(fetched[ref.target()])
+}
+
+// value returns the reference's value from the result of fetching its
+// target, with its key extracted and its transforms applied, see binary.go.
+func (ref secretRef) value(res fetchResult) (string, error) {
+	if res.err != nil {
+		return "", res.err
+	}
+	if res.binary {
+		return ref.binaryValue(res.value)
+	}
+
+	value, err := ref.extract(res.value)
+	if err != nil {
+		return "", err
+	}
+	return ref.transform(value)
+}
+
+// fetchAll fetches every target, grouping Secrets Manager targets into
+// BatchGetSecretValue calls and Parameter Store targets into GetParameters
+// calls per region and role. At most r.parallel API calls run at a time. Targets that
+// fail with a transient error are then tried in the fallback regions.
+//
+// With a cache, fresh entries are served without a fetch and failed
+// fetches may be replaced by stale entries. Targets already fetched in the
+// current pass are not fetched again.
+func (r *resolver) fetchAll(ctx context.Context, targets []fetchTarget) map[fetchTarget]fetchResult {
+	r.track(targets...)
+
+	results := make(map[fetchTarget]fetchResult, len(targets))
+	cached := make(map[fetchTarget]fetchResult)
+
+	// Batches are per region and role, in the order they are first referenced
+	var keys []clientKey
+	secretNames := make(map[clientKey][]string)
+	parameterNames := make(map[clientKey][]string)
+	var single []fetchTarget
+	for _, t := range targets {
+		if res, ok := r.pass[t]; ok {
+			cached[t] = res
+			continue
+		}
+		if !r.skipFresh {
+			if res, ok := r.cache.fresh(t); ok {
+				cached[t] = res
+				continue
+			}
+		}
+
+		if t.path || t.pinned() {
+			single = append(single, t)
+			continue
+		}
+		key := t.clientKey()
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+		if t.parameter {
+			parameterNames[key] = append(parameterNames[key], t.name)
+		} else {
+			secretNames[key] = append(secretNames[key], t.name)
+		}
+	}
+
+	var mu sync.Mutex
+	record := func(t fetchTarget, res fetchResult) {
+		mu.Lock()
+		results[t] = res
+		mu.Unlock()
+	}
+
+	var batches []func()
+	for _, key := range keys {
+		for _, names := range chunk(secretNames[key], secretsBatchSize) {
+			batches = append(batches, func() { r.fetchSecretBatch(ctx, key, names, record) })
+		}
+		for _, names := range chunk(parameterNames[key], parametersBatchSize) {
+			batches = append(batches, func() { r.fetchParameterBatch(ctx, key, names, record) })
+		}
+	}
+	for _, t := range single {
+		batches = append(batches, func() { record(t, r.fetch(ctx, t)) })
+	}
+	r.runLimited(batches)
+
+	if len(r.fallbackRegions) > 0 {
+		var failovers []func()
+		for t, res := range results {
+			if res.err == nil || !isTransient(res.err) {
+				continue
+			}
+			failovers = append(failovers, func() { record(t, r.failover(ctx, t, res.err)) })
+		}
+		r.runLimited(failovers)
+	}
+
+	r.cache.update(results)
+	for t, res := range cached {
+		results[t] = res
+	}
+	if r.pass != nil {
+		maps.Copy(r.pass, results)
+	}
+
+	return results
+}
+
+// runLimited runs every task, at most r.parallel at a time, and waits for
+// them to finish.
+func (r *resolver) runLimited(tasks []func()) {
+	sem := make(chan struct{}, max(r.parallel, 1))
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task func()) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			task()
+		}(task)
+	}
+	wg.Wait()
+}
+
+// writeFile writes or stages the secret file for the variable name and
+// returns its path.
+func (r *resolver) writeFile(name string, spec fileSpec, value []byte) (string, error) {
+	if r.staged == nil {
+		return writeSecretFile(r.secretsDir, name, spec, value)
+	}
+
+	path, err := secretFilePath(r.secretsDir, name, spec)
+	if err != nil {
+		return "", err
+	}
+	r.staged.add(path, spec, value)
+	return path, nil
+}
+
+// track records targets in r.tracked if tracking is enabled.
+func (r *resolver) track(targets ...fetchTarget) {
+	if r.tracked == nil {
+		return
+	}
+	for _, t := range targets {
+		r.tracked[t] = true
+	}
+}
+
+// fetch retrieves the raw value of a single target from its region.
+func (r *resolver) fetch(ctx context.Context, t fetchTarget) fetchResult {
+	c := r.clients(t.clientKey())
+	var res fetchResult
+	switch {
+	case t.path:
+		res.value, res.err = getParametersByPath(ctx, c.ssm, r.retry, t.name)
+	case t.parameter:
+		res.value, res.err = getParameter(ctx, c.ssm, r.retry, t.name)
+	default:
+		res.value, res.binary, res.err = getSecret(ctx, c.secrets, r.retry, t.name, t.versionID, t.versionStage)
+	}
+	return res
+}
+
 // resolveSecret resolves a single AWS secret reference to its actual value.
 //
 // The ref parameter should be in one of these formats:
 //   - "aws-secret:secret-name" for simple string secrets
 //   - "aws-secret:secret-name#key" for JSON secrets with key extraction
+//   - "aws-secret:secret-name:stage-or-version-id#key" for a pinned version
+//   - "aws-secret:arn:...:secret:name:json-key:version-stage:version-id" for
+//     an ECS valueFrom ARN
 //   - "aws-secret:/aws/reference/secretsmanager/param-name" for Parameter Store
+//   - "aws-ssm:/param/name" or "aws-ssm:/param/name:3#key" for native parameters
 //
 // Returns the resolved secret value or an error if resolution fails.
 //
 // Example:
 //
 //	value, err := resolveSecret(ctx, sm, ssm, "aws-secret:myapp/prod#db_url")
-func resolveSecret(ctx context.Context, secretsClient *secretsmanager.Client, ssmClient *ssm.Client, ref string) (string, error) {
-	trimmed := strings.TrimPrefix(ref, secretPrefix)
-	if trimmed == "" {
-		return "", fmt.Errorf("empty secret reference")
+func resolveSecret(ctx context.Context, secretsClient secretsManagerAPI, ssmClient ssmAPI, ref string) (string, error) {
+	parsed, err := parseSecretRef(ref)
+	if err != nil {
+		return "", err
 	}
 
-	// SSM Parameter Store reference
-	if strings.HasPrefix(trimmed, "/aws/reference/secretsmanager/") {
-		return getParameter(ctx, ssmClient, trimmed)
-	}
+	r := &resolver{secrets: secretsClient, ssm: ssmClient, parallel: 1}
+	return parsed.value(r.fetch(ctx, parsed.target()))
+}
 
-	// Secrets Manager reference
-	parts := strings.SplitN(trimmed, "#", 2)
-	secretName := parts[0]
-	if secretName == "" {
-		return "", fmt.Errorf("empty secret name")
+// isReference reports whether an environment value is a secret, parameter or
+// file reference.
+func isReference(value string) bool {
+	return strings.HasPrefix(value, secretPrefix) || strings.HasPrefix(value, parameterPrefix) || isFileReference(value)
+}
+
+// parseSecretRef parses an "aws-secret:", "aws-ssm:" or file reference without
+// contacting AWS. It is the entry point for every reference, see
+// reference.go for the grammar.
+//
+// Returns a referenceError naming the column of the first problem found.
+func parseSecretRef(ref string) (secretRef, error) {
+	syntax, err := scanReference(ref)
+	if err != nil {
+		return secretRef{}, err
 	}
+	return syntax.reference()
+}
 
-	secretValue, err := getSecret(ctx, secretsClient, secretName)
+// reference interprets the scanned target and options.
+func (syntax referenceSyntax) reference() (secretRef, error) {
+	var parsed secretRef
+	var err error
+	switch syntax.prefix {
+	case secretFilePrefix:
+		parsed, err = parseSecretBody(syntax.target, syntax.key, syntax.hasKey)
+		parsed.file = defaultFileSpec()
+	case parameterFilePrefix:
+		parsed, err = parseParameterRef(syntax.target, syntax.key, syntax.hasKey)
+		parsed.file = defaultFileSpec()
+	case parameterPrefix:
+		parsed, err = parseParameterRef(syntax.target, syntax.key, syntax.hasKey)
+	default:
+		parsed, err = parseSecretBody(syntax.target, syntax.key, syntax.hasKey)
+	}
 	if err != nil {
-		return "", err
+		return secretRef{}, atColumn(len(syntax.prefix)+1, err)
 	}
 
-	// If no key specified, return the raw secret
-	if len(parts) == 1 {
-		return secretValue, nil
+	for _, option := range syntax.options {
+		if err := parsed.setOption(option.name, option.value, option.hasValue); err != nil {
+			return secretRef{}, atColumn(option.column, err)
+		}
 	}
 
-	// Extract key from JSON secret
-	key := parts[1]
-	var parsed map[string]string
-	if err := json.Unmarshal([]byte(secretValue), &parsed); err != nil {
-		return "", fmt.Errorf("secret %s is not valid JSON: %w", secretName, err)
+	if parsed.role.arn == "" && parsed.role != (roleSpec{}) {
+		return secretRef{}, fmt.Errorf("options external-id and session-name require role")
 	}
 
-	value, exists := parsed[key]
-	if !exists {
-		return "", fmt.Errorf("key %s not found in secret %s", key, secretName)
+	// A full ARN names its own region
+	if region := arnRegion(parsed.name); region != "" {
+		if parsed.region != "" && parsed.region != region {
+			return secretRef{}, fmt.Errorf("region %s conflicts with region %s of ARN %s", parsed.region, region, parsed.name)
+		}
+		parsed.region = region
 	}
 
-	return value, nil
+	return parsed, nil
 }
 
-// getSecret retrieves a secret value from AWS Secrets Manager.
+// setOption applies one query or "|" option to the reference.
 //
-// The name parameter is the secret name or ARN. This function implements
-// retry logic with exponential backoff for handling transient AWS API errors.
+// Options:
+//   - version=SELECTOR: read a version, as the :selector after a name does
+//   - version-id=ID, version-stage=LABEL: read a secret version by ID or
+//     staging label, whatever its form
+//   - optional: a missing secret, parameter or key leaves the variable unset
+//   - default=VALUE: a missing secret, parameter or key yields VALUE
+//   - ignore-errors: apply optional or default= to every error, not only
+//     to "not found"
+//   - region=REGION: read from REGION instead of the default region, see
+//     region.go
+//   - role=ARN, external-id=ID, session-name=NAME: read with the
+//     credentials of an assumed role, see role.go
+//   - encoding=base64|hex, decode=base64|hex: encode binary secrets or
+//     decode encoded string secrets, see binary.go
 //
-// Returns the secret string value or an error if retrieval fails after all retries.
-func getSecret(ctx context.Context, client *secretsmanager.Client, name string) (string, error) {
-	var lastErr error
+// File references additionally accept the options described in files.go.
+func (ref *secretRef) setOption(key, value string, hasValue bool) error {
+	switch key {
+	case "version":
+		return ref.setVersion(value)
+	case "version-id", "version-stage":
+		return ref.setSecretVersion(key, value)
+	case "optional":
+		ref.optional = true
+	case "default":
+		if !hasValue {
+			return fmt.Errorf("option default requires a value (use default= for empty)")
+		}
+		ref.hasDefault = true
+		ref.defaultValue = value
+	case "ignore-errors":
+		ref.ignoreErrors = true
+	case "region":
+		if err := validateRegion(value); err != nil {
+			return err
+		}
+		ref.region = value
+	case "role":
+		if err := validateRoleARN(value); err != nil {
+			return err
+		}
+		ref.role.arn = value
+	case "external-id":
+		if value == "" {
+			return fmt.Errorf("option external-id requires a value")
+		}
+		ref.role.externalID = value
+	case "session-name":
+		if err := validateSessionName(value); err != nil {
+			return err
+		}
+		ref.role.sessionName = value
+	case "encoding":
+		if err := validateEncoding(key, value); err != nil {
+			return err
+		}
+		ref.encoding = value
+	case "decode":
+		if err := validateEncoding(key, value); err != nil {
+			return err
+		}
+		ref.decode = value
+	default:
+		if ref.file.enabled {
+			return ref.file.setOption(key, value)
+		}
+		return fmt.Errorf("unknown reference option %q", key)
+	}
+	return nil
+}
 
-	for i := 0; i < maxRetries; i++ {
-		if i > 0 {
-			select {
-			case <-ctx.Done():
-				return "", ctx.Err()
-			case <-time.After(retryDelay * time.Duration(i)):
-			}
+// setVersion applies a version= option. Secrets take a version ID or
+// staging label; parameters a version number or label, added to the name.
+func (ref *secretRef) setVersion(selector string) error {
+	if selector == "" {
+		return fmt.Errorf("option version requires a value")
+	}
+
+	if ref.parameter {
+		if ref.path {
+			return fmt.Errorf("parameter path %s cannot have a version", ref.name)
 		}
+		if strings.Contains(ref.name[strings.LastIndex(ref.name, "/")+1:], ":") {
+			return fmt.Errorf("parameter %s already selects a version", ref.name)
+		}
+		ref.name += ":" + selector
+		return nil
+	}
 
-		resp, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
-			SecretId: aws.String(name),
-		})
+	if ref.pinned() {
+		return fmt.Errorf("secret %s already selects a version", ref.name)
+	}
+	if isUUID(selector) {
+		ref.versionID = selector
+	} else {
+		ref.versionStage = selector
+	}
+	return nil
+}
+
+// setSecretVersion applies a version-id= or version-stage= option, which
+// pin a secret version without guessing the kind of selector from its form.
+func (ref *secretRef) setSecretVersion(key, value string) error {
+	if value == "" {
+		return fmt.Errorf("option %s requires a value", key)
+	}
+	if ref.parameter {
+		return fmt.Errorf("option %s applies to Secrets Manager secrets, use version= for parameters", key)
+	}
+	if ref.pinned() {
+		return fmt.Errorf("secret %s already selects a version", ref.name)
+	}
+
+	if key == "version-id" {
+		ref.versionID = value
+	} else {
+		ref.versionStage = value
+	}
+	return nil
+}
+
+// parseSecretBody parses the target and key of an "aws-secret:" reference.
+func parseSecretBody(name, key string, hasKey bool) (secretRef, error) {
+	if name == "" && !hasKey {
+		return secretRef{}, fmt.Errorf("empty secret reference")
+	}
+
+	// SSM Parameter Store reference
+	if strings.HasPrefix(name, ssmReferencePrefix) {
+		return secretRef{name: name, key: key, hasKey: hasKey, parameter: true}, nil
+	}
+
+	// Parameter ARN, as accepted by ECS valueFrom
+	if isParameterARN(name) {
+		return parseParameterRef(name, key, hasKey)
+	}
+
+	// Secrets Manager reference
+	if name == "" {
+		return secretRef{}, fmt.Errorf("empty secret name")
+	}
+
+	parsed := secretRef{name: name, key: key, hasKey: hasKey}
+
+	// ARNs may carry ECS valueFrom fields, see arn.go
+	if strings.HasPrefix(name, "arn:") {
+		arnRef, err := parseSecretARN(name)
 		if err != nil {
-			lastErr = err
-			continue
+			return secretRef{}, err
+		}
+		if arnRef.hasKey && hasKey {
+			return secretRef{}, fmt.Errorf("secret ARN %s has both a json-key field and a #key", name)
+		}
+		if hasKey {
+			arnRef.key, arnRef.hasKey = key, true
 		}
+		return arnRef, nil
+	}
 
-		if resp.SecretString == nil {
-			return "", fmt.Errorf("binary secrets not supported")
+	// Secret names cannot contain ':', so outside of ARNs a colon starts a
+	// version selector.
+	if base, selector, found := strings.Cut(name, ":"); found {
+		if base == "" {
+			return secretRef{}, fmt.Errorf("empty secret name")
+		}
+		if selector == "" {
+			return secretRef{}, fmt.Errorf("empty version selector for secret %s", base)
 		}
 
-		return *resp.SecretString, nil
+		parsed.name = base
+		if isUUID(selector) {
+			parsed.versionID = selector
+		} else {
+			parsed.versionStage = selector
+		}
 	}
 
-	return "", fmt.Errorf("failed after %d retries: %w", maxRetries, lastErr)
+	return parsed, nil
 }
 
-// getParameter retrieves a parameter value from AWS Systems Manager Parameter Store.
-//
-// The name parameter should be the full parameter path. Decryption is automatically
-// enabled for SecureString parameters. This function implements retry logic with
-// exponential backoff for handling transient AWS API errors.
+// parseParameterRef parses the target and key of an "aws-ssm:" reference.
 //
-// Returns the parameter value or an error if retrieval fails after all retries.
-func getParameter(ctx context.Context, client *ssm.Client, name string) (string, error) {
-	var lastErr error
+// Parameter names cannot contain '#', so the first '#' always starts a JSON
+// key. Version and label selectors are left on the name for SSM to interpret.
+func parseParameterRef(name, key string, hasKey bool) (secretRef, error) {
+	if name == "" && !hasKey {
+		return secretRef{}, fmt.Errorf("empty parameter reference")
+	}
+
+	if name == "" {
+		return secretRef{}, fmt.Errorf("empty parameter name")
+	}
 
-	for i := 0; i < maxRetries; i++ {
-		if i > 0 {
-			select {
-			case <-ctx.Done():
-				return "", ctx.Err()
-			case <-time.After(retryDelay * time.Duration(i)):
+	// Parameter names cannot end in '/', so a trailing slash names a path.
+	if strings.HasSuffix(name, "/") {
+		if hasKey {
+			return secretRef{}, fmt.Errorf("parameter path %s cannot have a key", name)
+		}
+		return secretRef{name: name, parameter: true, path: true}, nil
+	}
+
+	return secretRef{name: name, key: key, hasKey: hasKey, parameter: true}, nil
+}
+
+// isUUID reports whether s has the canonical 8-4-4-4-12 hex UUID form used
+// for Secrets Manager version IDs.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
 			}
 		}
+	}
+	return true
+}
+
+// target returns the AWS value the reference is read from.
+func (ref secretRef) target() fetchTarget {
+	return fetchTarget{
+		parameter:    ref.parameter,
+		path:         ref.path,
+		name:         ref.name,
+		versionID:    ref.versionID,
+		versionStage: ref.versionStage,
+		region:       ref.region,
+		role:         ref.role,
+	}
+}
+
+// describe returns the reference without its options, for error reports.
+func (ref secretRef) describe() string {
+	if !ref.parameter && strings.HasPrefix(ref.name, "arn:") {
+		return ref.describeSecretARN()
+	}
+
+	var b strings.Builder
+	if ref.parameter {
+		b.WriteString(parameterPrefix)
+	} else {
+		b.WriteString(secretPrefix)
+	}
+	b.WriteString(ref.name)
+
+	switch {
+	case ref.versionID != "":
+		b.WriteString(":" + ref.versionID)
+	case ref.versionStage != "":
+		b.WriteString(":" + ref.versionStage)
+	}
+	if ref.hasKey {
+		b.WriteString("#" + escapeReference(ref.key))
+	}
+
+	return b.String()
+}
 
-		resp, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+// extract applies the reference's JSON key, if any, to a fetched value.
+func (ref secretRef) extract(secretValue string) (string, error) {
+	// If no key specified, return the raw secret
+	if !ref.hasKey {
+		return secretValue, nil
+	}
+
+	// Extract key or nested path from JSON secret
+	if !json.Valid([]byte(secretValue)) {
+		return "", &invalidJSONError{name: ref.name}
+	}
+
+	value, exists, err := lookupJSONPath([]byte(secretValue), ref.key)
+	if err != nil {
+		return "", fmt.Errorf("secret %s: %w", ref.name, err)
+	}
+	if !exists {
+		return "", &keyNotFoundError{key: ref.key, name: ref.name}
+	}
+
+	return value, nil
+}
+
+// tolerates reports whether a failure to resolve the reference with err
+// should fall back to its default or leave it unset rather than abort.
+func (ref secretRef) tolerates(err error) bool {
+	if !ref.optional && !ref.hasDefault && !ref.ignoreErrors {
+		return false
+	}
+	return ref.ignoreErrors || isNotFound(err)
+}
+
+// getSecret retrieves a secret value from AWS Secrets Manager.
+//
+// The name parameter is the secret name or ARN. If versionID or versionStage
+// is non-empty that version is requested, otherwise AWSCURRENT is returned.
+// Transient AWS API errors are retried according to policy.
+//
+// Returns the secret string value, or the raw bytes of a binary secret with
+// binary set, or an error if retrieval fails.
+func getSecret(ctx context.Context, client secretsManagerAPI, policy retryPolicy, name, versionID, versionStage string) (value string, binary bool, err error) {
+	input := &secretsmanager.GetSecretValueInput{SecretId: aws.String(name)}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	if versionStage != "" {
+		input.VersionStage = aws.String(versionStage)
+	}
+
+	var resp *secretsmanager.GetSecretValueOutput
+	err = policy.do(ctx, func(callCtx context.Context) error {
+		var err error
+		resp, err = client.GetSecretValue(callCtx, input)
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	value, binary = secretPayload(resp.SecretString, resp.SecretBinary)
+	return value, binary, nil
+}
+
+// getParameter retrieves a parameter value from AWS Systems Manager Parameter Store.
+//
+// The name parameter should be the full parameter path, optionally followed by
+// a ":version" or ":label" selector. Decryption is automatically
+// enabled for SecureString parameters. Transient AWS API errors are retried
+// according to policy.
+//
+// Returns the parameter value or an error if retrieval fails.
+func getParameter(ctx context.Context, client ssmAPI, policy retryPolicy, name string) (string, error) {
+	var resp *ssm.GetParameterOutput
+	err := policy.do(ctx, func(callCtx context.Context) error {
+		var err error
+		resp, err = client.GetParameter(callCtx, &ssm.GetParameterInput{
 			Name:           aws.String(name),
 			WithDecryption: aws.Bool(true),
 		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Parameter == nil || resp.Parameter.Value == nil {
+		return "", fmt.Errorf("parameter has no value")
+	}
+
+	return *resp.Parameter.Value, nil
+}
+
+// getParametersByPath retrieves every parameter under path from Parameter Store.
+//
+// The lookup is recursive, follows pagination and decrypts SecureString
+// parameters. The result is a JSON object mapping each parameter name, relative
+// to path, to its value, so that it can be expanded like a JSON secret.
+//
+// Returns an error if any page fails.
+func getParametersByPath(ctx context.Context, client ssmAPI, policy retryPolicy, path string) (string, error) {
+	values := make(map[string]string)
+
+	input := &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	}
+	for {
+		var resp *ssm.GetParametersByPathOutput
+		err := policy.do(ctx, func(callCtx context.Context) error {
+			var err error
+			resp, err = client.GetParametersByPath(callCtx, input)
+			return err
+		})
 		if err != nil {
-			lastErr = err
-			continue
+			return "", err
+		}
+
+		for _, p := range resp.Parameters {
+			values[strings.TrimPrefix(aws.ToString(p.Name), path)] = aws.ToString(p.Value)
 		}
 
-		if resp.Parameter == nil || resp.Parameter.Value == nil {
-			return "", fmt.Errorf("parameter has no value")
+		if resp.NextToken == nil {
+			break
 		}
+		input.NextToken = resp.NextToken
+	}
 
-		return *resp.Parameter.Value, nil
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return "", err
 	}
 
-	return "", fmt.Errorf("failed after %d retries: %w", maxRetries, lastErr)
+	return string(encoded), nil
 }
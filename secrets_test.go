@@ -3,11 +3,249 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
 )
 
+// fakeSecretsManager serves secrets from memory and records every call.
+type fakeSecretsManager struct {
+	mu         sync.Mutex
+	secrets    map[string]string
+	binary     map[string][]byte // secrets stored as SecretBinary
+	errs       map[string]error
+	hang       map[string]bool   // calls for these names block until cancelled
+	versions   map[string]string // AWSCURRENT version ID by name, default "v1"
+	calls      map[string]int
+	batchCalls int
+	batchErr   error
+	inflight   int
+	peak       int
+	delay      time.Duration
+}
+
+func newFakeSecretsManager(secrets map[string]string) *fakeSecretsManager {
+	return &fakeSecretsManager{secrets: secrets, calls: make(map[string]int)}
+}
+
+// enter records the start of a call and returns a func that records its end.
+func (f *fakeSecretsManager) enter(names ...string) func() {
+	f.mu.Lock()
+	for _, name := range names {
+		f.calls[name]++
+	}
+	f.inflight++
+	if f.inflight > f.peak {
+		f.peak = f.inflight
+	}
+	f.mu.Unlock()
+
+	if f.delay > 0 {
+		time.Sleep(f.delay)
+	}
+
+	return func() {
+		f.mu.Lock()
+		f.inflight--
+		f.mu.Unlock()
+	}
+}
+
+func (f *fakeSecretsManager) GetSecretValue(ctx context.Context, in *secretsmanager.GetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	name := aws.ToString(in.SecretId)
+	defer f.enter(name)()
+
+	// Pinned versions are stored as "name:selector".
+	key := name
+	if in.VersionId != nil {
+		key += ":" + *in.VersionId
+	} else if in.VersionStage != nil {
+		key += ":" + *in.VersionStage
+	}
+
+	if f.hang[key] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if err := f.errs[key]; err != nil {
+		return nil, err
+	}
+	if data, ok := f.binary[key]; ok {
+		return &secretsmanager.GetSecretValueOutput{Name: aws.String(name), SecretBinary: data}, nil
+	}
+	value, ok := f.secrets[key]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "ResourceNotFoundException", Message: "secret not found"}
+	}
+	return &secretsmanager.GetSecretValueOutput{Name: aws.String(name), SecretString: aws.String(value)}, nil
+}
+
+func (f *fakeSecretsManager) BatchGetSecretValue(ctx context.Context, in *secretsmanager.BatchGetSecretValueInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.BatchGetSecretValueOutput, error) {
+	f.mu.Lock()
+	f.batchCalls++
+	f.mu.Unlock()
+
+	if f.batchErr != nil {
+		return nil, f.batchErr
+	}
+
+	defer f.enter(in.SecretIdList...)()
+
+	for _, name := range in.SecretIdList {
+		if f.hang[name] {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+	}
+
+	out := &secretsmanager.BatchGetSecretValueOutput{}
+	for _, name := range in.SecretIdList {
+		var apiErr smithy.APIError
+		if errors.As(f.errs[name], &apiErr) {
+			out.Errors = append(out.Errors, smtypes.APIErrorType{
+				SecretId:  aws.String(name),
+				ErrorCode: aws.String(apiErr.ErrorCode()),
+				Message:   aws.String(apiErr.ErrorMessage()),
+			})
+			continue
+		}
+		if data, ok := f.binary[name]; ok {
+			out.SecretValues = append(out.SecretValues, smtypes.SecretValueEntry{Name: aws.String(name), SecretBinary: data})
+			continue
+		}
+		value, ok := f.secrets[name]
+		if !ok {
+			out.Errors = append(out.Errors, smtypes.APIErrorType{
+				SecretId:  aws.String(name),
+				ErrorCode: aws.String("ResourceNotFoundException"),
+				Message:   aws.String("Secrets Manager can't find the specified secret."),
+			})
+			continue
+		}
+		out.SecretValues = append(out.SecretValues, smtypes.SecretValueEntry{Name: aws.String(name), SecretString: aws.String(value)})
+	}
+	return out, nil
+}
+
+func (f *fakeSecretsManager) DescribeSecret(ctx context.Context, in *secretsmanager.DescribeSecretInput, _ ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error) {
+	name := aws.ToString(in.SecretId)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["describe:"+name]++
+
+	if _, ok := f.secrets[name]; !ok {
+		return nil, &smithy.GenericAPIError{Code: "ResourceNotFoundException", Message: "secret not found"}
+	}
+	version := f.versions[name]
+	if version == "" {
+		version = "v1"
+	}
+	return &secretsmanager.DescribeSecretOutput{
+		Name:               aws.String(name),
+		VersionIdsToStages: map[string][]string{version: {"AWSCURRENT"}, "v0": {"AWSPREVIOUS"}},
+	}, nil
+}
+
+// fakeSSM serves parameters from memory and records every call.
+type fakeSSM struct {
+	mu         sync.Mutex
+	params     map[string]string
+	versions   map[string]int64 // version by name, default 0
+	calls      map[string]int
+	batchCalls int
+}
+
+func newFakeSSM(params map[string]string) *fakeSSM {
+	return &fakeSSM{params: params, calls: make(map[string]int)}
+}
+
+func (f *fakeSSM) GetParameter(ctx context.Context, in *ssm.GetParameterInput, _ ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	name := aws.ToString(in.Name)
+
+	f.mu.Lock()
+	f.calls[name]++
+	f.mu.Unlock()
+
+	if strings.HasPrefix(name, ssmReferencePrefix) && !aws.ToBool(in.WithDecryption) {
+		return nil, &smithy.GenericAPIError{Code: "ValidationException", Message: "WithDecryption flag must be True for retrieving a Secret Manager secret"}
+	}
+	value, ok := f.params[name]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "ParameterNotFound", Message: "parameter not found"}
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Name: aws.String(name), Value: aws.String(value), Version: f.versions[name]}}, nil
+}
+
+// GetParametersByPath returns matching parameters two at a time to exercise pagination.
+func (f *fakeSSM) GetParametersByPath(ctx context.Context, in *ssm.GetParametersByPathInput, _ ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+	path := aws.ToString(in.Path)
+
+	f.mu.Lock()
+	f.calls[path]++
+	f.mu.Unlock()
+
+	var names []string
+	for name := range f.params {
+		if strings.HasPrefix(name, path) && (aws.ToBool(in.Recursive) || !strings.Contains(name[len(path):], "/")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start := 0
+	if in.NextToken != nil {
+		start, _ = strconv.Atoi(*in.NextToken)
+	}
+	end := min(start+2, len(names))
+
+	out := &ssm.GetParametersByPathOutput{}
+	for _, name := range names[start:end] {
+		out.Parameters = append(out.Parameters, ssmtypes.Parameter{Name: aws.String(name), Value: aws.String(f.params[name]), Version: f.versions[name]})
+	}
+	if end < len(names) {
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	return out, nil
+}
+
+func (f *fakeSSM) GetParameters(ctx context.Context, in *ssm.GetParametersInput, _ ...func(*ssm.Options)) (*ssm.GetParametersOutput, error) {
+	f.mu.Lock()
+	f.batchCalls++
+	for _, name := range in.Names {
+		f.calls[name]++
+	}
+	f.mu.Unlock()
+
+	out := &ssm.GetParametersOutput{}
+	for _, name := range in.Names {
+		value, ok := f.params[name]
+		if !ok {
+			out.InvalidParameters = append(out.InvalidParameters, name)
+			continue
+		}
+		base, selector, _ := strings.Cut(name, ":")
+		p := ssmtypes.Parameter{Name: aws.String(base), Value: aws.String(value)}
+		if selector != "" {
+			p.Selector = aws.String(":" + selector)
+		}
+		out.Parameters = append(out.Parameters, p)
+	}
+	return out, nil
+}
+
 func TestResolveSecretsDetailed(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -53,7 +291,7 @@ func TestResolveSecretsDetailed(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
 			defer cancel()
 
-			result, err := resolveSecrets(ctx, tt.env)
+			result, err := resolveSecrets(ctx, tt.env, newSharedResolver(defaultOptions()))
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("resolveSecrets() error = %v, wantErr %v", err, tt.wantErr)
@@ -74,6 +312,310 @@ func TestResolveSecretsDetailed(t *testing.T) {
 	}
 }
 
+func TestResolverDeduplicatesFetches(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/prod":  `{"db":"postgres://db","api":"key123","user":"app"}`,
+		"myapp/token": "tok",
+	})
+	ps := newFakeSSM(map[string]string{
+		"/aws/reference/secretsmanager/myapp/token": "ssm-tok",
+	})
+	r := &resolver{secrets: sm, ssm: ps, parallel: 4}
+
+	env := []string{
+		"DB=aws-secret:myapp/prod#db",
+		"API=aws-secret:myapp/prod#api",
+		"USER=aws-secret:myapp/prod#user",
+		"TOKEN=aws-secret:myapp/token",
+		"TOKEN2=aws-secret:myapp/token",
+		"PARAM=aws-secret:/aws/reference/secretsmanager/myapp/token",
+		"PARAM2=aws-secret:/aws/reference/secretsmanager/myapp/token",
+		"NORMAL=value",
+	}
+
+	result, err := r.resolve(context.Background(), env)
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	want := map[string]string{
+		"DB":     "postgres://db",
+		"API":    "key123",
+		"USER":   "app",
+		"TOKEN":  "tok",
+		"TOKEN2": "tok",
+		"PARAM":  "ssm-tok",
+		"PARAM2": "ssm-tok",
+		"NORMAL": "value",
+	}
+	got := envSliceToMap(result)
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+
+	for name, n := range sm.calls {
+		if n != 1 {
+			t.Errorf("secret %s fetched %d times, want 1", name, n)
+		}
+	}
+	for name, n := range ps.calls {
+		if n != 1 {
+			t.Errorf("parameter %s fetched %d times, want 1", name, n)
+		}
+	}
+}
+
+func TestResolverParallelismCap(t *testing.T) {
+	secrets := make(map[string]string)
+	var env []string
+	for i := 0; i < 5*secretsBatchSize; i++ {
+		name := fmt.Sprintf("secret-%d", i)
+		secrets[name] = "value-" + name
+		env = append(env, fmt.Sprintf("VAR_%d=aws-secret:%s", i, name))
+	}
+
+	sm := newFakeSecretsManager(secrets)
+	sm.delay = 20 * time.Millisecond
+	r := &resolver{secrets: sm, parallel: 3}
+
+	if _, err := r.resolve(context.Background(), env); err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	if sm.peak > 3 {
+		t.Errorf("peak concurrency = %d, want <= 3", sm.peak)
+	}
+	if sm.peak < 2 {
+		t.Errorf("peak concurrency = %d, fetches did not run concurrently", sm.peak)
+	}
+}
+
+func TestResolverReportsAllFailingVariables(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"ok": "value"})
+	r := &resolver{secrets: sm, parallel: 4}
+
+	env := []string{
+		"GOOD=aws-secret:ok",
+		"FIRST=aws-secret:missing-1",
+		"SECOND=aws-secret:missing-2",
+	}
+
+	_, err := r.resolve(context.Background(), env)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	msg := err.Error()
+	first, second := strings.Index(msg, "FIRST"), strings.Index(msg, "SECOND")
+	if first < 0 || second < first {
+		t.Errorf("error = %v, want it to name FIRST then SECOND", err)
+	}
+	if strings.Contains(msg, "GOOD") {
+		t.Errorf("error = %v, want it not to name GOOD", err)
+	}
+}
+
+func TestParseSecretRefVersions(t *testing.T) {
+	tests := []struct {
+		name      string
+		ref       string
+		want      secretRef
+		wantErr   bool
+		wantError string
+	}{
+		{
+			name: "current version",
+			ref:  "aws-secret:myapp/prod#password",
+			want: secretRef{name: "myapp/prod", key: "password", hasKey: true},
+		},
+		{
+			name: "staging label",
+			ref:  "aws-secret:myapp/prod:AWSPREVIOUS#password",
+			want: secretRef{name: "myapp/prod", key: "password", hasKey: true, versionStage: "AWSPREVIOUS"},
+		},
+		{
+			name: "custom label without key",
+			ref:  "aws-secret:myapp/prod:canary",
+			want: secretRef{name: "myapp/prod", versionStage: "canary"},
+		},
+		{
+			name: "non-uuid selector is a label",
+			ref:  "aws-secret:myapp/prod:EXAMPLE1-90ab-cdef-fedc-ba987EXAMPLE#password",
+			want: secretRef{name: "myapp/prod", key: "password", hasKey: true, versionStage: "EXAMPLE1-90ab-cdef-fedc-ba987EXAMPLE"},
+		},
+		{
+			name: "uuid version id",
+			ref:  "aws-secret:myapp/prod:01234567-89ab-cdef-0123-456789abcdef",
+			want: secretRef{name: "myapp/prod", versionID: "01234567-89ab-cdef-0123-456789abcdef"},
+		},
+		{
+			name: "arn is not split",
+			ref:  "aws-secret:arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/prod-AbCdEf#password",
+			want: secretRef{name: "arn:aws:secretsmanager:us-east-1:123456789012:secret:myapp/prod-AbCdEf", key: "password", hasKey: true, region: "us-east-1"},
+		},
+		{
+			name: "key may contain colon",
+			ref:  "aws-secret:myapp/prod#a:b",
+			want: secretRef{name: "myapp/prod", key: "a:b", hasKey: true},
+		},
+		{
+			name: "parameter selector passed through",
+			ref:  "aws-secret:/aws/reference/secretsmanager/myapp/token:3",
+			want: secretRef{name: "/aws/reference/secretsmanager/myapp/token:3", parameter: true},
+		},
+		{
+			name:    "empty selector",
+			ref:     "aws-secret:myapp/prod:#password",
+			wantErr: true,
+		},
+		{
+			name:    "selector without name",
+			ref:     "aws-secret::AWSPREVIOUS",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSecretRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSecretRef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseSecretRef() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverPinnedVersions(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/db":             `{"password":"current"}`,
+		"myapp/db:AWSPREVIOUS": `{"password":"previous"}`,
+		"myapp/db:AWSPENDING":  `{"password":"pending"}`,
+	})
+	ps := newFakeSSM(map[string]string{
+		"/aws/reference/secretsmanager/flag":   "v-latest",
+		"/aws/reference/secretsmanager/flag:3": "v3",
+	})
+	r := &resolver{secrets: sm, ssm: ps, parallel: 4}
+
+	env := []string{
+		"CURRENT=aws-secret:myapp/db#password",
+		"PREVIOUS=aws-secret:myapp/db:AWSPREVIOUS#password",
+		"PENDING=aws-secret:myapp/db:AWSPENDING#password",
+		"FLAG=aws-secret:/aws/reference/secretsmanager/flag",
+		"FLAG3=aws-secret:/aws/reference/secretsmanager/flag:3",
+	}
+
+	result, err := r.resolve(context.Background(), env)
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	want := map[string]string{
+		"CURRENT":  "current",
+		"PREVIOUS": "previous",
+		"PENDING":  "pending",
+		"FLAG":     "v-latest",
+		"FLAG3":    "v3",
+	}
+	got := envSliceToMap(result)
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestParseParameterRef(t *testing.T) {
+	tests := []struct {
+		name    string
+		ref     string
+		want    secretRef
+		wantErr bool
+	}{
+		{
+			name: "plain parameter",
+			ref:  "aws-ssm:/myapp/prod/feature_flag",
+			want: secretRef{name: "/myapp/prod/feature_flag", parameter: true},
+		},
+		{
+			name: "public parameter",
+			ref:  "aws-ssm:/aws/service/global-infrastructure/regions",
+			want: secretRef{name: "/aws/service/global-infrastructure/regions", parameter: true},
+		},
+		{
+			name: "arn with key",
+			ref:  "aws-ssm:arn:aws:ssm:us-east-1:123456789012:parameter/myapp/db#host",
+			want: secretRef{name: "arn:aws:ssm:us-east-1:123456789012:parameter/myapp/db", key: "host", hasKey: true, parameter: true, region: "us-east-1"},
+		},
+		{
+			name: "version selector",
+			ref:  "aws-ssm:/myapp/prod/config:3",
+			want: secretRef{name: "/myapp/prod/config:3", parameter: true},
+		},
+		{
+			name:    "empty reference",
+			ref:     "aws-ssm:",
+			wantErr: true,
+		},
+		{
+			name:    "empty name",
+			ref:     "aws-ssm:#key",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSecretRef(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSecretRef() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseSecretRef() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverNativeParameters(t *testing.T) {
+	ps := newFakeSSM(map[string]string{
+		"/myapp/prod/feature_flag": "on",
+		"/myapp/prod/db":           `{"host":"db.internal"}`,
+		"/myapp/prod/db:2":         `{"host":"db-old.internal"}`,
+	})
+	r := &resolver{ssm: ps, parallel: 2}
+
+	env := []string{
+		"FLAG=aws-ssm:/myapp/prod/feature_flag",
+		"DB_HOST=aws-ssm:/myapp/prod/db#host",
+		"OLD_DB_HOST=aws-ssm:/myapp/prod/db:2#host",
+	}
+
+	result, err := r.resolve(context.Background(), env)
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	want := map[string]string{
+		"FLAG":        "on",
+		"DB_HOST":     "db.internal",
+		"OLD_DB_HOST": "db-old.internal",
+	}
+	got := envSliceToMap(result)
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if ps.calls["/myapp/prod/db"] != 1 {
+		t.Errorf("/myapp/prod/db fetched %d times, want 1", ps.calls["/myapp/prod/db"])
+	}
+}
+
 func TestSecretParsing(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -0,0 +1,224 @@
+// Package main provides config file templating with resolved secrets.
+//
+// This file contains functions for rendering Go text/template files before
+// the child process starts, for applications that read configuration files
+// rather than environment variables.
+//
+// # Template List
+//
+// Templates are given as SRC[:DST] with the repeatable -template flag or as a
+// comma-separated AWS_INIT_TEMPLATES list. Without DST, a ".tmpl" suffix is
+// removed from SRC:
+//
+//	aws-init -template /etc/app/config.yaml.tmpl python app.py
+//	AWS_INIT_TEMPLATES=/etc/app/config.yaml.tmpl,/etc/nginx/auth.tmpl:/etc/nginx/auth.conf
+//
+// The rendered file is written atomically, readable and writable only by its
+// owner (0600) whatever the template's permissions, and, like secret files,
+// removed when the child process exits.
+//
+// # Template Functions
+//
+//	secret "myapp/prod#password"   value of an aws-secret: reference
+//	parameter "/myapp/prod/host"   value of an aws-ssm: reference
+//	jsonKey "db.host" VALUE        nested JSON path lookup, see jsonpath.go
+//	yaml VALUE                     double-quoted YAML scalar
+//	json VALUE                     JSON string literal
+//	shell VALUE                    single-quoted POSIX shell word
+//
+// The resolved environment is available as .Env:
+//
+//	database:
+//	  host: {{ secret "myapp/prod" | jsonKey "host" | yaml }}
+//	  password: {{ secret "myapp/prod#password" | yaml }}
+//	  region: {{ .Env.AWS_REGION }}
+//
+// References accept the usual options, so {{ secret "myapp/prod#dsn|default=" }}
+// renders an empty string when the key does not exist.
+//
+// Each distinct secret or parameter is fetched once across all templates.
+// Any rendering error aborts startup.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	templateSuffix = ".tmpl"
+	// templateFileMode keeps rendered secrets private, even when the
+	// template itself is world-readable.
+	templateFileMode = 0o600
+)
+
+// templateSpec is a parsed SRC[:DST] template argument.
+type templateSpec struct {
+	src string
+	dst string
+}
+
+// templateData is the value passed to templates as dot.
+type templateData struct {
+	Env map[string]string
+}
+
+// templateRenderer renders templates, sharing fetched values between them.
+type templateRenderer struct {
+	ctx   context.Context
+	r     *resolver
+	cache map[fetchTarget]fetchResult
+}
+
+// parseTemplateSpec parses a SRC[:DST] template argument.
+func parseTemplateSpec(s string) (templateSpec, error) {
+	src, dst, _ := strings.Cut(s, ":")
+	if src == "" {
+		return templateSpec{}, fmt.Errorf("empty template source in %q", s)
+	}
+
+	if dst == "" {
+		if !strings.HasSuffix(src, templateSuffix) || len(src) == len(templateSuffix) {
+			return templateSpec{}, fmt.Errorf("template %s: destination required when source has no %s suffix", src, templateSuffix)
+		}
+		dst = strings.TrimSuffix(src, templateSuffix)
+	}
+
+	return templateSpec{src: src, dst: dst}, nil
+}
+
+// renderTemplates renders every template in specs using values from AWS and
+// the resolved environment env. Secrets already fetched for the environment
+// by shared are not fetched again.
+//
+// Returns an error naming the first template that fails to parse, execute or
+// be written.
+func renderTemplates(ctx context.Context, specs []string, env []string, shared *sharedResolver) error {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	r, err := shared.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	return r.renderTemplates(ctx, specs, env)
+}
+
+// renderTemplates renders every template in specs with r.
+func (r *resolver) renderTemplates(ctx context.Context, specs []string, env []string) error {
+	data := templateData{Env: make(map[string]string, len(env))}
+	for _, e := range env {
+		if name, value, found := strings.Cut(e, "="); found {
+			data.Env[name] = value
+		}
+	}
+
+	tr := &templateRenderer{ctx: ctx, r: r, cache: make(map[fetchTarget]fetchResult)}
+	for _, s := range specs {
+		spec, err := parseTemplateSpec(s)
+		if err != nil {
+			return err
+		}
+		if err := tr.render(spec, data); err != nil {
+			return fmt.Errorf("template %s: %w", spec.src, err)
+		}
+	}
+
+	return nil
+}
+
+// render executes one template and writes the result to its destination.
+func (tr *templateRenderer) render(spec templateSpec, data templateData) error {
+	source, err := os.ReadFile(spec.src)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.New(filepath.Base(spec.src)).
+		Option("missingkey=error").
+		Funcs(tr.funcs()).
+		Parse(string(source))
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return err
+	}
+
+	dst, err := filepath.Abs(spec.dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = tr.r.writeFile("", fileSpec{path: dst, mode: templateFileMode, uid: -1, gid: -1}, out.Bytes())
+	return err
+}
+
+// funcs returns the template function map.
+func (tr *templateRenderer) funcs() template.FuncMap {
+	return template.FuncMap{
+		"secret": func(ref string) (string, error) {
+			return tr.lookup(secretPrefix + ref)
+		},
+		"parameter": func(ref string) (string, error) {
+			return tr.lookup(parameterPrefix + ref)
+		},
+		"jsonKey": func(path, value string) (string, error) {
+			result, found, err := lookupJSONPath([]byte(value), path)
+			if err != nil {
+				return "", err
+			}
+			if !found {
+				return "", fmt.Errorf("key %s not found", path)
+			}
+			return result, nil
+		},
+		"yaml":  quoteJSON,
+		"json":  quoteJSON,
+		"shell": quoteShell,
+	}
+}
+
+// lookup resolves a single reference, fetching each target at most once.
+func (tr *templateRenderer) lookup(ref string) (string, error) {
+	parsed, err := parseSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+
+	t := parsed.target()
+	if _, ok := tr.cache[t]; !ok {
+		tr.cache[t] = tr.r.fetchAll(tr.ctx, []fetchTarget{t})[t]
+	}
+
+	value, err := parsed.lookup(tr.cache)
+	if err != nil && parsed.tolerates(err) {
+		return parsed.defaultValue, nil
+	}
+	return value, err
+}
+
+// quoteJSON returns s as a JSON string literal. JSON strings are also valid
+// double-quoted YAML scalars, so this serves both formats.
+func quoteJSON(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s) // encoding a string cannot fail
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// quoteShell returns s as a single-quoted POSIX shell word.
+func quoteShell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
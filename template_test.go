@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTemplateSpec(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    templateSpec
+		wantErr bool
+	}{
+		{in: "/etc/app/config.yaml.tmpl", want: templateSpec{src: "/etc/app/config.yaml.tmpl", dst: "/etc/app/config.yaml"}},
+		{in: "/etc/app/auth.tpl:/etc/app/auth.conf", want: templateSpec{src: "/etc/app/auth.tpl", dst: "/etc/app/auth.conf"}},
+		{in: "/etc/app/config.yaml", wantErr: true},
+		{in: ".tmpl", wantErr: true},
+		{in: ":/etc/app/config.yaml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseTemplateSpec(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTemplateSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseTemplateSpec() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuoting(t *testing.T) {
+	tests := []struct {
+		fn   func(string) string
+		in   string
+		want string
+	}{
+		{quoteJSON, `p@ss"w\ord`, `"p@ss\"w\\ord"`},
+		{quoteJSON, "line1\nline2 <&>", `"line1\nline2 <&>"`},
+		{quoteShell, "it's", `'it'\''s'`},
+		{quoteShell, "$HOME `id`", "'$HOME `id`'"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.fn(tt.in); got != tt.want {
+			t.Errorf("quote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	t.Cleanup(removeSecretFiles)
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "config.yaml.tmpl")
+	content := `db:
+  host: {{ secret "myapp/prod" | jsonKey "db.host" | yaml }}
+  port: {{ secret "myapp/prod#db.port" }}
+  password: {{ secret "myapp/prod#password" | yaml }}
+flag: {{ parameter "/myapp/flag" | json }}
+region: {{ .Env.AWS_REGION }}
+cmd: echo {{ secret "myapp/prod#password" | shell }}
+`
+	if err := os.WriteFile(src, []byte(content), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/prod": `{"db":{"host":"db.internal","port":5432},"password":"it's \"secret\""}`,
+	})
+	ps := newFakeSSM(map[string]string{"/myapp/flag": "on"})
+	r := &resolver{secrets: sm, ssm: ps, parallel: 1}
+
+	if err := r.renderTemplates(context.Background(), []string{src}, []string{"AWS_REGION=us-east-1"}); err != nil {
+		t.Fatalf("renderTemplates() error = %v", err)
+	}
+
+	dst := filepath.Join(dir, "config.yaml")
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `db:
+  host: "db.internal"
+  port: 5432
+  password: "it's \"secret\""
+flag: "on"
+region: us-east-1
+cmd: echo 'it'\''s "secret"'
+`
+	if string(got) != want {
+		t.Errorf("rendered:\n%s\nwant:\n%s", got, want)
+	}
+
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != templateFileMode {
+		t.Errorf("rendered mode = %o, want %o, not the template's 640", info.Mode().Perm(), templateFileMode)
+	}
+
+	if sm.calls["myapp/prod"] != 1 {
+		t.Errorf("myapp/prod fetched %d times, want 1", sm.calls["myapp/prod"])
+	}
+}
+
+func TestRenderTemplatesSharesEnvironmentFetches(t *testing.T) {
+	t.Cleanup(removeSecretFiles)
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "auth.conf.tmpl")
+	if err := os.WriteFile(src, []byte(`password {{ secret "myapp/prod#password" }}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := newFakeSecretsManager(map[string]string{"myapp/prod": `{"password":"hunter2"}`})
+	shared := &sharedResolver{r: &resolver{secrets: sm, parallel: 1, pass: make(map[fetchTarget]fetchResult)}}
+
+	env, err := resolveSecrets(context.Background(), []string{"PASSWORD=aws-secret:myapp/prod#password"}, shared)
+	if err != nil {
+		t.Fatalf("resolveSecrets() error = %v", err)
+	}
+	if err := renderTemplates(context.Background(), []string{src}, env, shared); err != nil {
+		t.Fatalf("renderTemplates() error = %v", err)
+	}
+
+	if got, _ := os.ReadFile(filepath.Join(dir, "auth.conf")); string(got) != "password hunter2" {
+		t.Errorf("rendered %q", got)
+	}
+	if sm.calls["myapp/prod"] != 1 {
+		t.Errorf("myapp/prod fetched %d times, want 1", sm.calls["myapp/prod"])
+	}
+}
+
+func TestRenderTemplatesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "missing secret", content: `{{ secret "missing" }}`, wantErr: "ResourceNotFoundException"},
+		{name: "missing key", content: `{{ secret "myapp/prod#nope" }}`, wantErr: "not found"},
+		{name: "missing env", content: `{{ .Env.NOPE }}`, wantErr: "NOPE"},
+		{name: "syntax error", content: `{{ secret }`, wantErr: "config.tmpl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "config.tmpl")
+			if err := os.WriteFile(src, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			r := &resolver{secrets: newFakeSecretsManager(map[string]string{"myapp/prod": `{}`}), parallel: 1}
+			err := r.renderTemplates(context.Background(), []string{src}, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("renderTemplates() error = %v, want %q", err, tt.wantErr)
+			}
+
+			if _, statErr := os.Stat(filepath.Join(dir, "config")); !os.IsNotExist(statErr) {
+				t.Error("destination written despite error")
+			}
+		})
+	}
+}
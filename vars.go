@@ -0,0 +1,179 @@
+// Package main provides ${VAR} expansion inside secret references.
+//
+// This file contains the functions that build reference names from the
+// container's other environment variables, so that one image can be
+// deployed to several stages:
+//
+//	STAGE=prod
+//	DATABASE_URL=aws-secret:myapp/${STAGE}#database_url
+//
+// # Evaluation Order
+//
+// Variables are looked up in the environment aws-init was started with,
+// before any reference is resolved, so the order of variables does not
+// matter. Only plain variables can be used; a variable whose value is
+// itself a reference is an error. A plain variable may in turn contain
+// ${VAR}, which is expanded the same way for the lookup, while the variable
+// itself is passed to the child unchanged:
+//
+//	APP=myapp/${STAGE}
+//	DATABASE_URL=aws-secret:${APP}#database_url
+//
+// A variable that refers back to itself, directly or through others, is
+// reported as a cycle. An unset variable is an error; an empty one expands
+// to nothing.
+//
+// # Scope
+//
+// Expansion applies to environment references, interpolated references and
+// expand directives, anywhere in the reference including its key and
+// options. Text outside references is never expanded. Expanded values are
+// literal: characters such as '#' or '|' in a variable do not start a key
+// or option. Write \${ for a literal ${ in a reference.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// plainVars expands ${VAR} from the plain variables of an environment.
+type plainVars struct {
+	values   map[string]string
+	expanded map[string]string // memoized expansions
+	active   []string          // variables being expanded, for cycles
+}
+
+// newPlainVars returns the variables of env for expansion.
+func newPlainVars(env []string) *plainVars {
+	v := &plainVars{values: make(map[string]string, len(env)), expanded: make(map[string]string)}
+	for _, e := range env {
+		if name, value, found := strings.Cut(e, "="); found {
+			v.values[name] = value
+		}
+	}
+	return v
+}
+
+// expand replaces every ${VAR} in ref with the escaped value of VAR. A nil
+// receiver leaves ref unchanged.
+//
+// Returns a referenceError at the ${ of an unset, reference-valued or
+// cyclic variable.
+func (v *plainVars) expand(ref string) (string, error) {
+	if v == nil || !strings.Contains(ref, "${") {
+		return ref, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(ref); i++ {
+		switch {
+		case ref[i] == '\\' && i+1 < len(ref):
+			b.WriteString(ref[i : i+2])
+			i++
+		case strings.HasPrefix(ref[i:], "${"):
+			name, ok := variableName(ref[i+2:])
+			if !ok {
+				b.WriteByte(ref[i])
+				continue
+			}
+
+			value, err := v.lookup(name)
+			if err != nil {
+				return "", &referenceError{column: i + 1, err: err}
+			}
+			b.WriteString(escapeVariable(value))
+			i += len("${") + len(name) // at the closing '}'
+		default:
+			b.WriteByte(ref[i])
+		}
+	}
+
+	return b.String(), nil
+}
+
+// lookup returns the value of the plain variable name with its own ${VAR}
+// expanded.
+func (v *plainVars) lookup(name string) (string, error) {
+	if value, ok := v.expanded[name]; ok {
+		return value, nil
+	}
+
+	for i, active := range v.active {
+		if active == name {
+			return "", fmt.Errorf("variable cycle: %s -> %s", strings.Join(v.active[i:], " -> "), name)
+		}
+	}
+
+	value, ok := v.values[name]
+	if !ok {
+		return "", fmt.Errorf("variable %s is not set", name)
+	}
+	if isReference(value) || isInterpolated(value) || isExpandDirective(name) {
+		return "", fmt.Errorf("variable %s is a reference, only plain variables can be used", name)
+	}
+
+	v.active = append(v.active, name)
+	defer func() { v.active = v.active[:len(v.active)-1] }()
+
+	expanded, err := v.expandPlain(value)
+	if err != nil {
+		return "", err
+	}
+	v.expanded[name] = expanded
+	return expanded, nil
+}
+
+// expandPlain replaces every ${VAR} in the plain value s. Unlike in
+// references, backslashes have no special meaning.
+func (v *plainVars) expandPlain(s string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+
+		name, ok := variableName(s[i+2:])
+		if !ok {
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+
+		value, err := v.lookup(name)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		s = s[i+2+len(name)+1:]
+	}
+}
+
+// variableName returns the variable name at the start of s if it is
+// followed by '}', as in the rest of "${NAME}".
+func variableName(s string) (string, bool) {
+	end := strings.IndexByte(s, '}')
+	if end <= 0 {
+		return "", false
+	}
+
+	name := s[:end]
+	for i, c := range name {
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && (i == 0 || !('0' <= c && c <= '9')) {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// escapeVariable escapes a variable's value so that it is literal within
+// a reference.
+func escapeVariable(s string) string {
+	if !strings.Contains(s, "#") {
+		return escapeReference(s)
+	}
+	return strings.ReplaceAll(escapeReference(s), "#", `\#`)
+}
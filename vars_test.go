@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPlainVarsExpand(t *testing.T) {
+	env := []string{
+		"STAGE=prod",
+		"APP=myapp/${STAGE}",
+		"ODD=a#b|c",
+		"EMPTY=",
+		"LOOP_A=${LOOP_B}",
+		"LOOP_B=x/${LOOP_A}",
+		"SELF=${SELF}",
+		"SECRET=aws-secret:myapp/token",
+	}
+
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr string
+	}{
+		{ref: "aws-secret:myapp/${STAGE}#url", want: "aws-secret:myapp/prod#url"},
+		{ref: "aws-secret:${APP}/db", want: "aws-secret:myapp/prod/db"},
+		{ref: "aws-secret:myapp/db#${STAGE}|default=${STAGE}", want: "aws-secret:myapp/db#prod|default=prod"},
+		{ref: "aws-secret:myapp/${ODD}", want: `aws-secret:myapp/a\#b\|c`},
+		{ref: "aws-secret:myapp${EMPTY}/db", want: "aws-secret:myapp/db"},
+		{ref: `aws-secret:myapp/db|default=\${STAGE}`, want: `aws-secret:myapp/db|default=\${STAGE}`},
+		{ref: "aws-secret:myapp/${not a name}", want: "aws-secret:myapp/${not a name}"},
+		{ref: "aws-secret:myapp/${UNSET}", wantErr: "column 18: variable UNSET is not set"},
+		{ref: "aws-secret:${LOOP_A}", wantErr: "variable cycle: LOOP_A -> LOOP_B -> LOOP_A"},
+		{ref: "aws-secret:${SELF}", wantErr: "variable cycle: SELF -> SELF"},
+		{ref: "aws-secret:${SECRET}", wantErr: "variable SECRET is a reference"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := newPlainVars(env).expand(tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expand() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expand() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverExpandsVariables(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/prod": `{"database_url":"postgres://prod","password":"hunter2","port":"5432"}`,
+	})
+	r := &resolver{secrets: sm, ssm: newFakeSSM(nil), parallel: 2}
+
+	env := []string{
+		"DATABASE_URL=aws-secret:myapp/${STAGE}#database_url",
+		"DSN=postgres://app:${aws-secret:myapp/${STAGE}#password}@db/${DB_NAME}",
+		"AWS_INIT_EXPAND_APP=aws-secret:myapp/${STAGE}|prefix=APP_|case=upper",
+		"STAGE=prod",
+		"APP=myapp/${STAGE}",
+	}
+	result, err := r.resolve(context.Background(), env)
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	got := envSliceToMap(result)
+	want := map[string]string{
+		"DATABASE_URL": "postgres://prod",
+		"DSN":          "postgres://app:hunter2@db/${DB_NAME}",
+		"APP_PORT":     "5432",
+		"STAGE":        "prod",
+		"APP":          "myapp/${STAGE}",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if n := sm.calls["myapp/prod"]; n != 1 {
+		t.Errorf("myapp/prod fetched %d times, want 1", n)
+	}
+}
+
+func TestResolverReportsUnsetVariable(t *testing.T) {
+	r := &resolver{secrets: newFakeSecretsManager(nil), ssm: newFakeSSM(nil), parallel: 1}
+
+	_, err := r.resolve(context.Background(), []string{"DATABASE_URL=aws-secret:myapp/${STAGE}#database_url"})
+	want := "failed to resolve DATABASE_URL: invalid reference: column 18: variable STAGE is not set"
+	if err == nil || err.Error() != want {
+		t.Errorf("resolve() error = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,383 @@
+// Package main provides rotation watching for resolved secrets.
+//
+// This file contains functions that poll the versions of every secret and
+// parameter aws-init resolved and, when one of them changes, for example
+// after a Secrets Manager rotation, either restart the child process with
+// freshly resolved values or refresh its files and signal it to reload.
+//
+// # Watch Mode
+//
+// Watching is opt-in with -watch-interval or AWS_INIT_WATCH_INTERVAL:
+//
+//	aws-init -watch-interval 5m -watch-jitter 30s python app.py
+//
+// Each poll is delayed by a random extra wait of up to the jitter, so that
+// replicas do not poll in lockstep. The versions the child started with are
+// read once it is running, so that watching does not delay its start. Polls
+// check targets concurrently, bounded by the resolution timeout, and only
+// read metadata:
+//
+//	Secrets Manager   DescribeSecret, the version ID holding the requested stage
+//	                  (also for /aws/reference/secretsmanager/ references)
+//	Parameter Store   GetParameter without decryption, the parameter version
+//	Parameter paths   GetParametersByPath without decryption, every name and version
+//
+// Secrets pinned to a version ID are never polled.
+//
+// # Restart
+//
+// On a change, environment references and templates are resolved again. If
+// that succeeds, the child is stopped with SIGTERM through the usual
+// graceful shutdown and started with the new environment. If it fails, the
+// child keeps running with the old values and the change is retried on the
+// next poll.
+//
+// # Reload
+//
+// With -watch-signal or AWS_INIT_WATCH_SIGNAL, the child is not restarted.
+// Secret files and templates are rewritten in place and the signal is sent
+// to the child instead, for applications such as nginx that reload their
+// configuration on SIGHUP:
+//
+//	aws-init -watch-interval 5m -watch-signal HUP nginx -g 'daemon off;'
+//
+// The child's environment cannot change without a restart, so reload mode
+// suits values delivered through files and templates.
+//
+// Files and templates are only written once every reference has resolved,
+// so a failed refresh leaves the previous material in place.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+const defaultVersionStage = "AWSCURRENT"
+
+// watcher polls the versions of resolved targets and re-resolves the
+// environment when they change.
+type watcher struct {
+	r        *resolver
+	environ  []string // environment before resolution
+	opts     options
+	signal   os.Signal // reload signal; nil restarts the child instead
+	versions map[fetchTarget]string
+}
+
+// executeWatched resolves environ with the resolver of shared, runs
+// command, and restarts it whenever a referenced secret or parameter
+// changes. label names the child in logs, as for execute. ctx bounds the
+// initial resolution only.
+//
+// Returns an error if the initial resolution fails; otherwise returns the
+// exit code of the child as execute does.
+func executeWatched(ctx context.Context, command string, args []string, environ []string, label string, shared *sharedResolver) (int, error) {
+	opts := shared.opts
+	r, err := shared.get(ctx)
+	if err != nil {
+		return 1, err
+	}
+	r.tracked = make(map[fetchTarget]bool)
+
+	w := &watcher{r: r, environ: environ, opts: opts}
+	if opts.watchSignal != "" {
+		if w.signal, err = parseSignal(opts.watchSignal); err != nil {
+			return 1, fmt.Errorf("invalid watch signal: %w", err)
+		}
+	}
+	env, err := w.prepare(ctx)
+	if err != nil {
+		return 1, err
+	}
+
+	// Polling outlives the initial resolution and stops with the child
+	watchCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	restarts := make(chan []string)
+	reloads := make(chan os.Signal)
+	go w.run(watchCtx, restarts, reloads)
+
+	return supervise(command, args, env, label, restarts, reloads), nil
+}
+
+// refresh prepares the environment again after a detected change, bounded
+// by the resolution timeout. Fresh cache entries would still hold the
+// values from before the change, so every target is fetched; stale entries
+// still replace failed fetches.
+func (w *watcher) refresh() ([]string, error) {
+	ctx, cancel := w.opts.resolveContext(context.Background())
+	defer cancel()
+
+	w.r.skipFresh = true
+	w.r.pass = make(map[fetchTarget]fetchResult)
+	defer func() { w.r.skipFresh = false }()
+
+	return w.prepare(ctx)
+}
+
+// prepare resolves the environment and renders templates within ctx.
+// Secret files and rendered templates are written only if everything
+// succeeds.
+func (w *watcher) prepare(ctx context.Context) ([]string, error) {
+	// The pass ends here, so that the next refresh fetches again
+	stage := &fileStage{}
+	w.r.staged = stage
+	defer func() { w.r.staged, w.r.pass = nil, nil }()
+
+	env, err := w.r.resolve(ctx, w.environ)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.r.renderTemplates(ctx, w.opts.templates.values, env); err != nil {
+		return nil, err
+	}
+	if err := stage.commit(); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// run polls until ctx is cancelled. After every detected change it sends
+// the reload signal on reloads if one is configured, or a freshly resolved
+// environment on restarts otherwise.
+//
+// Unless versions are already known, run first reads the baseline versions
+// that later polls are compared with.
+func (w *watcher) run(ctx context.Context, restarts chan<- []string, reloads chan<- os.Signal) {
+	if w.versions == nil {
+		// Targets that cannot be checked now are picked up by the first poll
+		versions, err := w.poll(ctx)
+		if err != nil {
+			log.Printf("aws-init: warning: %v", err)
+		}
+		w.versions = versions
+	}
+
+	for {
+		delay := w.opts.watchInterval
+		if w.opts.watchJitter > 0 {
+			delay += rand.N(w.opts.watchJitter + 1)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		versions, err := w.poll(ctx)
+		if err != nil {
+			log.Printf("aws-init: warning: %v", err)
+		}
+
+		changed := w.changed(versions)
+		if len(changed) == 0 {
+			continue
+		}
+		log.Printf("aws-init: %s changed", strings.Join(changed, ", "))
+
+		env, err := w.refresh()
+		if err != nil {
+			log.Printf("aws-init: warning: keeping current secrets: %v", err)
+			continue
+		}
+
+		for t, v := range versions {
+			w.versions[t] = v
+		}
+
+		if w.signal != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case reloads <- w.signal:
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case restarts <- env:
+		}
+	}
+}
+
+// poll returns the current version of every tracked target that can change.
+// Targets are checked concurrently, at most r.parallel at a time, and the
+// whole poll is bounded by the resolution timeout.
+//
+// Returns the versions it could read and an error naming a target that
+// could not be checked.
+func (w *watcher) poll(ctx context.Context) (map[fetchTarget]string, error) {
+	ctx, cancel := w.opts.resolveContext(ctx)
+	defer cancel()
+
+	versions := make(map[fetchTarget]string)
+	var mu sync.Mutex
+	var firstErr error
+
+	var checks []func()
+	for t := range w.r.tracked {
+		if t.versionID != "" {
+			continue // pinned versions never change
+		}
+
+		checks = append(checks, func() {
+			v, err := w.r.version(ctx, t)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to check version of %s: %w", t.name, err)
+				}
+				return
+			}
+			versions[t] = v
+		})
+	}
+	w.r.runLimited(checks)
+
+	return versions, firstErr
+}
+
+// changed returns the sorted names of targets whose version differs from
+// the last known one. Targets without a known version are recorded, not
+// reported.
+func (w *watcher) changed(versions map[fetchTarget]string) []string {
+	if w.versions == nil {
+		w.versions = make(map[fetchTarget]string)
+	}
+
+	var names []string
+	for t, v := range versions {
+		old, known := w.versions[t]
+		if !known {
+			w.versions[t] = v
+			continue
+		}
+		if v != old {
+			names = append(names, t.name)
+		}
+	}
+	slices.Sort(names)
+
+	return slices.Compact(names)
+}
+
+// version returns an opaque identifier that changes whenever the value of t
+// changes, without reading the value itself.
+func (r *resolver) version(ctx context.Context, t fetchTarget) (string, error) {
+	c := r.clients(t.clientKey())
+	switch {
+	case t.path:
+		return getPathVersion(ctx, c.ssm, r.retry, t.name)
+	case t.parameter && !strings.HasPrefix(t.name, ssmReferencePrefix):
+		return getParameterVersion(ctx, c.ssm, r.retry, t.name)
+	}
+
+	// Parameter Store rejects Secrets Manager references without decryption,
+	// so those are checked with DescribeSecret like any other secret
+
+	stage := t.versionStage
+	if stage == "" {
+		stage = defaultVersionStage
+	}
+	return getSecretVersion(ctx, c.secrets, r.retry, strings.TrimPrefix(t.name, ssmReferencePrefix), stage)
+}
+
+// getSecretVersion returns the ID of the secret version that currently holds
+// stage, using DescribeSecret.
+func getSecretVersion(ctx context.Context, client secretsManagerAPI, policy retryPolicy, name, stage string) (string, error) {
+	var resp *secretsmanager.DescribeSecretOutput
+	err := policy.do(ctx, func(callCtx context.Context) error {
+		var err error
+		resp, err = client.DescribeSecret(callCtx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(name)})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for id, stages := range resp.VersionIdsToStages {
+		if slices.Contains(stages, stage) {
+			return id, nil
+		}
+	}
+
+	return "", fmt.Errorf("no version of secret %s has stage %s", name, stage)
+}
+
+// getParameterVersion returns the version number of a parameter without
+// decrypting it. The name may carry a ":version" or ":label" selector.
+func getParameterVersion(ctx context.Context, client ssmAPI, policy retryPolicy, name string) (string, error) {
+	var resp *ssm.GetParameterOutput
+	err := policy.do(ctx, func(callCtx context.Context) error {
+		var err error
+		resp, err = client.GetParameter(callCtx, &ssm.GetParameterInput{
+			Name:           aws.String(name),
+			WithDecryption: aws.Bool(false),
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Parameter == nil {
+		return "", fmt.Errorf("parameter %s has no metadata", name)
+	}
+
+	return strconv.FormatInt(resp.Parameter.Version, 10), nil
+}
+
+// getPathVersion returns the name and version of every parameter under path,
+// so that added, removed and updated parameters are all detected.
+func getPathVersion(ctx context.Context, client ssmAPI, policy retryPolicy, path string) (string, error) {
+	var entries []string
+
+	input := &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(false),
+	}
+	for {
+		var resp *ssm.GetParametersByPathOutput
+		err := policy.do(ctx, func(callCtx context.Context) error {
+			var err error
+			resp, err = client.GetParametersByPath(callCtx, input)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+
+		for _, p := range resp.Parameters {
+			entries = append(entries, aws.ToString(p.Name)+"@"+strconv.FormatInt(p.Version, 10))
+		}
+
+		if resp.NextToken == nil {
+			break
+		}
+		input.NextToken = resp.NextToken
+	}
+	slices.Sort(entries)
+
+	return strings.Join(entries, ","), nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestWatcherDetectsChanges(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{
+		"myapp/db": `{"password":"one"}`,
+		"myapp/db:01234567-89ab-cdef-0123-456789abcdef": "pinned",
+	})
+	ps := newFakeSSM(map[string]string{
+		"/myapp/host":        "db.internal",
+		"/myapp/config/port": "5432",
+	})
+	r := &resolver{secrets: sm, ssm: ps, parallel: 2, tracked: make(map[fetchTarget]bool)}
+	w := &watcher{r: r}
+
+	_, err := r.resolve(context.Background(), []string{
+		"PASSWORD=aws-secret:myapp/db#password",
+		"PINNED=aws-secret:myapp/db:01234567-89ab-cdef-0123-456789abcdef",
+		"HOST=aws-ssm:/myapp/host",
+		"AWS_INIT_EXPAND_CONFIG=aws-ssm:/myapp/config/",
+	})
+	if err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	versions, err := w.poll(context.Background())
+	if err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+	if len(versions) != 3 {
+		t.Errorf("poll() returned %d versions, want 3 (pinned version skipped)", len(versions))
+	}
+	if got := w.changed(versions); len(got) != 0 {
+		t.Errorf("changed() on baseline = %v, want none", got)
+	}
+
+	sm.versions = map[string]string{"myapp/db": "v2"}
+	ps.versions = map[string]int64{"/myapp/config/port": 2}
+
+	versions, err = w.poll(context.Background())
+	if err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+	want := []string{"/myapp/config/", "myapp/db"}
+	if got := w.changed(versions); !slices.Equal(got, want) {
+		t.Errorf("changed() = %v, want %v", got, want)
+	}
+}
+
+func TestWatcherRunSendsRefreshedEnvironment(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"myapp/db": "secret"})
+	r := &resolver{secrets: sm, parallel: 1, tracked: make(map[fetchTarget]bool)}
+	w := &watcher{r: r, environ: []string{"PASSWORD=aws-secret:myapp/db"}, opts: options{watchInterval: 5 * time.Millisecond}}
+
+	if _, err := w.prepare(context.Background()); err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+	versions, err := w.poll(context.Background())
+	if err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+	w.versions = versions
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarts := make(chan []string)
+
+	sm.mu.Lock()
+	sm.versions = map[string]string{"myapp/db": "v2"}
+	sm.mu.Unlock()
+	go w.run(ctx, restarts, nil)
+
+	select {
+	case env := <-restarts:
+		if !slices.Equal(env, []string{"PASSWORD=secret"}) {
+			t.Errorf("restart env = %v", env)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no restart after version change")
+	}
+}
+
+func TestWatcherRefreshKeepsFilesOnFailure(t *testing.T) {
+	t.Cleanup(removeSecretFiles)
+	path := filepath.Join(t.TempDir(), "tls.key")
+
+	sm := newFakeSecretsManager(map[string]string{"myapp/tls": "old-key", "myapp/other": "x"})
+	r := &resolver{secrets: sm, parallel: 1, tracked: make(map[fetchTarget]bool)}
+	w := &watcher{r: r, environ: []string{
+		"TLS_KEY=aws-secret-file:myapp/tls|path=" + path,
+		"OTHER=aws-secret:myapp/other",
+	}}
+
+	if _, err := w.prepare(context.Background()); err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+
+	// A failure anywhere must leave the file untouched
+	sm.secrets["myapp/tls"] = "new-key"
+	sm.errs = map[string]error{"myapp/other": &smithy.GenericAPIError{Code: "AccessDeniedException"}}
+	if _, err := w.prepare(context.Background()); err == nil {
+		t.Fatal("prepare() succeeded, want error")
+	}
+	if got, _ := os.ReadFile(path); string(got) != "old-key" {
+		t.Errorf("file after failed refresh = %q, want old-key", got)
+	}
+
+	sm.errs = nil
+	if _, err := w.prepare(context.Background()); err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "new-key" {
+		t.Errorf("file after refresh = %q, want new-key", got)
+	}
+}
+
+func TestWatcherRunSendsReloadSignal(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"myapp/db": "secret"})
+	r := &resolver{secrets: sm, parallel: 1, tracked: make(map[fetchTarget]bool)}
+	w := &watcher{
+		r:       r,
+		environ: []string{"PASSWORD=aws-secret:myapp/db"},
+		opts:    options{watchInterval: 5 * time.Millisecond},
+		signal:  syscall.SIGHUP,
+	}
+
+	if _, err := w.prepare(context.Background()); err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+	versions, err := w.poll(context.Background())
+	if err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+	w.versions = versions
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarts := make(chan []string)
+	reloads := make(chan os.Signal)
+
+	sm.mu.Lock()
+	sm.versions = map[string]string{"myapp/db": "v2"}
+	sm.mu.Unlock()
+	go w.run(ctx, restarts, reloads)
+
+	select {
+	case sig := <-reloads:
+		if sig != syscall.SIGHUP {
+			t.Errorf("reload signal = %v, want SIGHUP", sig)
+		}
+	case <-restarts:
+		t.Fatal("child restarted, want reload signal")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload after version change")
+	}
+}
+
+func TestWatcherRunTakesBaseline(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"myapp/db": "secret"})
+	r := &resolver{secrets: sm, parallel: 1, tracked: make(map[fetchTarget]bool)}
+	w := &watcher{
+		r:       r,
+		environ: []string{"PASSWORD=aws-secret:myapp/db"},
+		opts:    options{watchInterval: time.Hour},
+	}
+
+	if _, err := w.prepare(context.Background()); err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx, make(chan []string), make(chan os.Signal))
+
+	// The baseline is read at once rather than after the first interval
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sm.mu.Lock()
+		calls := sm.calls["describe:myapp/db"]
+		sm.mu.Unlock()
+		if calls > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("run() did not read the baseline versions")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatcherRefreshBypassesFreshCache(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"myapp/db": "old"})
+	r := &resolver{secrets: sm, parallel: 1, tracked: make(map[fetchTarget]bool), cache: newTestCache(t, time.Hour, 24*time.Hour)}
+	w := &watcher{r: r, environ: []string{"PASSWORD=aws-secret:myapp/db"}}
+
+	if _, err := w.prepare(context.Background()); err != nil {
+		t.Fatalf("prepare() error = %v", err)
+	}
+
+	sm.secrets["myapp/db"] = "new"
+	env, err := w.refresh()
+	if err != nil {
+		t.Fatalf("refresh() error = %v", err)
+	}
+	if !slices.Equal(env, []string{"PASSWORD=new"}) {
+		t.Errorf("refresh() = %v, want the rotated value", env)
+	}
+
+	// An outage during a refresh still falls back to the cache
+	sm.errs = map[string]error{"myapp/db": &smithy.GenericAPIError{Code: "ThrottlingException"}}
+	env, err = w.refresh()
+	if err != nil {
+		t.Fatalf("refresh() during outage error = %v", err)
+	}
+	if !slices.Equal(env, []string{"PASSWORD=new"}) {
+		t.Errorf("refresh() during outage = %v, want the cached value", env)
+	}
+	if r.skipFresh {
+		t.Error("skipFresh still set after refresh()")
+	}
+}
+
+func TestWatcherPollsSecretsManagerReferences(t *testing.T) {
+	sm := newFakeSecretsManager(map[string]string{"myapp/db": "unused"})
+	ps := newFakeSSM(map[string]string{ssmReferencePrefix + "myapp/db": "secret"})
+	r := &resolver{secrets: sm, ssm: ps, parallel: 1, tracked: make(map[fetchTarget]bool)}
+	w := &watcher{r: r}
+
+	if _, err := r.resolve(context.Background(), []string{"PASSWORD=aws-secret:" + ssmReferencePrefix + "myapp/db"}); err != nil {
+		t.Fatalf("resolve() error = %v", err)
+	}
+
+	versions, err := w.poll(context.Background())
+	if err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+	w.versions = versions
+
+	sm.versions = map[string]string{"myapp/db": "v2"}
+	versions, err = w.poll(context.Background())
+	if err != nil {
+		t.Fatalf("poll() error = %v", err)
+	}
+	if got, want := w.changed(versions), []string{ssmReferencePrefix + "myapp/db"}; !slices.Equal(got, want) {
+		t.Errorf("changed() = %v, want %v", got, want)
+	}
+	if sm.calls["describe:myapp/db"] != 2 {
+		t.Errorf("DescribeSecret calls = %d, want 2", sm.calls["describe:myapp/db"])
+	}
+}